@@ -0,0 +1,344 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PROXY_AUTHORIZATION_HEADER = "Proxy-Authorization"
+	PROXY_AUTHENTICATE_HEADER  = "Proxy-Authenticate"
+	WWW_AUTHENTICATE_HEADER    = "WWW-Authenticate"
+	DEFAULT_REALM              = "opera-proxy"
+	DIGEST_NONCE_TTL           = 1 * time.Hour
+	AUTH_REQUIRED_MSG          = "Proxy authentication required\n"
+	UNAUTHORIZED_MSG           = "Authentication required\n"
+)
+
+// Auth checks proxy credentials of incoming HTTP requests.
+type Auth interface {
+	// Validate returns authenticated username and true if request carries
+	// valid credentials. Otherwise it responds with 407 challenge on its own
+	// and returns false.
+	Validate(wr http.ResponseWriter, req *http.Request) (string, bool)
+}
+
+func requireAuth(wr http.ResponseWriter, challenges ...string) {
+	for _, c := range challenges {
+		wr.Header().Add(PROXY_AUTHENTICATE_HEADER, c)
+	}
+	http.Error(wr, AUTH_REQUIRED_MSG, http.StatusProxyAuthRequired)
+}
+
+type BasicAuth struct {
+	store CredStore
+	realm string
+}
+
+func NewBasicAuth(store CredStore, realm string) *BasicAuth {
+	if realm == "" {
+		realm = DEFAULT_REALM
+	}
+	return &BasicAuth{
+		store: store,
+		realm: realm,
+	}
+}
+
+func (a *BasicAuth) challenge() string {
+	return fmt.Sprintf("Basic realm=%q", a.realm)
+}
+
+func (a *BasicAuth) Validate(wr http.ResponseWriter, req *http.Request) (string, bool) {
+	username, password, ok := parseBasicAuth(req.Header.Get(PROXY_AUTHORIZATION_HEADER))
+	if !ok || !a.store.Verify(username, password) {
+		requireAuth(wr, a.challenge())
+		return "", false
+	}
+	return username, true
+}
+
+// RequireBasicAuth wraps handler of regular HTTP server, not proxy, so
+// only requests with Basic credentials accepted by store reach next.
+func RequireBasicAuth(store CredStore, realm string, next http.Handler) http.Handler {
+	if realm == "" {
+		realm = DEFAULT_REALM
+	}
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		username, password, ok := req.BasicAuth()
+		if !ok || !store.Verify(username, password) {
+			wr.Header().Set(WWW_AUTHENTICATE_HEADER, fmt.Sprintf("Basic realm=%q", realm))
+			http.Error(wr, UNAUTHORIZED_MSG, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(wr, req)
+	})
+}
+
+func parseBasicAuth(header string) (string, string, bool) {
+	const prefix = "basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", false
+	}
+	return username, password, true
+}
+
+// RequestUsername returns username passed in Proxy-Authorization header of
+// request using Basic or Digest scheme. Credentials are not verified.
+func RequestUsername(req *http.Request) string {
+	header := req.Header.Get(PROXY_AUTHORIZATION_HEADER)
+	scheme, rest, _ := strings.Cut(header, " ")
+	switch {
+	case strings.EqualFold(scheme, "basic"):
+		username, _, _ := parseBasicAuth(header)
+		return username
+	case strings.EqualFold(scheme, "digest"):
+		return parseDigestParams(rest)["username"]
+	}
+	return ""
+}
+
+// DigestAuth implements RFC 2617 Digest authentication with MD5 algorithm
+// and "auth" quality of protection. Nonces carry issue timestamp signed
+// with a random per-process key. Last nonce count is remembered for every
+// nonce in use, so captured responses can't be replayed.
+type DigestAuth struct {
+	store PlainCredStore
+	realm string
+	key   []byte
+	basic *BasicAuth
+
+	ncMux     sync.Mutex
+	nonceUses map[string]nonceUse
+	lastPrune time.Time
+}
+
+type nonceUse struct {
+	nc     uint64
+	issued time.Time
+}
+
+// NewDigestAuth returns Digest authenticator. If allowBasic is set, Basic
+// credentials are accepted as well and both challenges are offered.
+func NewDigestAuth(store PlainCredStore, realm string, allowBasic bool) (*DigestAuth, error) {
+	if realm == "" {
+		realm = DEFAULT_REALM
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("unable to generate nonce key: %w", err)
+	}
+	res := &DigestAuth{
+		store:     store,
+		realm:     realm,
+		key:       key,
+		nonceUses: make(map[string]nonceUse),
+		lastPrune: time.Now(),
+	}
+	if allowBasic {
+		res.basic = NewBasicAuth(store, realm)
+	}
+	return res, nil
+}
+
+func (a *DigestAuth) newNonce() string {
+	buf := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(buf, uint64(time.Now().Unix()))
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(buf)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(buf))
+}
+
+// checkNonce returns issue time of nonce, whether nonce was issued by us
+// and whether it's still fresh.
+func (a *DigestAuth) checkNonce(nonce string) (issued time.Time, valid, fresh bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(raw) != 8+sha256.Size {
+		return time.Time{}, false, false
+	}
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(raw[:8])
+	if !hmac.Equal(mac.Sum(nil), raw[8:]) {
+		return time.Time{}, false, false
+	}
+	issued = time.Unix(int64(binary.BigEndian.Uint64(raw[:8])), 0)
+	return issued, true, time.Since(issued) < DIGEST_NONCE_TTL
+}
+
+// useNonce records nonce count nc for nonce. It returns false if nc
+// doesn't exceed count seen before, which means response is replayed.
+func (a *DigestAuth) useNonce(nonce string, issued time.Time, nc uint64) bool {
+	a.ncMux.Lock()
+	defer a.ncMux.Unlock()
+	now := time.Now()
+	if now.Sub(a.lastPrune) >= DIGEST_NONCE_TTL {
+		// Expired nonces are rejected anyway, so their counts aren't needed
+		for n, use := range a.nonceUses {
+			if now.Sub(use.issued) >= DIGEST_NONCE_TTL {
+				delete(a.nonceUses, n)
+			}
+		}
+		a.lastPrune = now
+	}
+	if use, ok := a.nonceUses[nonce]; ok && nc <= use.nc {
+		return false
+	}
+	a.nonceUses[nonce] = nonceUse{nc: nc, issued: issued}
+	return true
+}
+
+func (a *DigestAuth) challenges(stale bool) []string {
+	c := fmt.Sprintf("Digest realm=%q, qop=\"auth\", algorithm=MD5, nonce=%q", a.realm, a.newNonce())
+	if stale {
+		c += ", stale=true"
+	}
+	res := []string{c}
+	if a.basic != nil {
+		res = append(res, a.basic.challenge())
+	}
+	return res
+}
+
+func (a *DigestAuth) Validate(wr http.ResponseWriter, req *http.Request) (string, bool) {
+	header := req.Header.Get(PROXY_AUTHORIZATION_HEADER)
+	scheme, rest, _ := strings.Cut(header, " ")
+	switch {
+	case strings.EqualFold(scheme, "digest"):
+		username, ok, stale := a.validateDigest(req.Method, digestURIs(req), rest)
+		if ok {
+			return username, true
+		}
+		requireAuth(wr, a.challenges(stale)...)
+		return "", false
+	case strings.EqualFold(scheme, "basic") && a.basic != nil:
+		username, password, ok := parseBasicAuth(header)
+		if ok && a.store.Verify(username, password) {
+			return username, true
+		}
+	}
+	requireAuth(wr, a.challenges(false)...)
+	return "", false
+}
+
+// digestURIs returns digest-uri values which match request. Clients send
+// either request target as is or, for absolute-form targets, its path.
+func digestURIs(req *http.Request) []string {
+	res := []string{req.RequestURI}
+	if req.URL != nil && req.URL.IsAbs() {
+		res = append(res, req.URL.RequestURI())
+	}
+	return res
+}
+
+// validateDigest checks digest response for request with method. Response
+// must be made for one of request URIs and carry nonce count greater than
+// any seen before for its nonce.
+func (a *DigestAuth) validateDigest(method string, requestURIs []string, params string) (username string, ok, stale bool) {
+	p := parseDigestParams(params)
+	username = p["username"]
+	if username == "" || p["realm"] != a.realm || p["uri"] == "" || !slices.Contains(requestURIs, p["uri"]) {
+		return "", false, false
+	}
+	if alg := p["algorithm"]; alg != "" && !strings.EqualFold(alg, "MD5") {
+		return "", false, false
+	}
+	// Only "auth" qop is offered. Responses without qop carry no nonce
+	// count, so they can't be protected from replay.
+	if p["qop"] != "auth" || p["cnonce"] == "" {
+		return "", false, false
+	}
+	nc, err := strconv.ParseUint(p["nc"], 16, 32)
+	if err != nil {
+		return "", false, false
+	}
+	issued, valid, fresh := a.checkNonce(p["nonce"])
+	if !valid {
+		return "", false, false
+	}
+	password, found := a.store.Password(username)
+	if !found {
+		return "", false, false
+	}
+
+	ha1 := md5hex(username + ":" + a.realm + ":" + password)
+	ha2 := md5hex(method + ":" + p["uri"])
+	expected := md5hex(ha1 + ":" + p["nonce"] + ":" + p["nc"] + ":" + p["cnonce"] + ":" + p["qop"] + ":" + ha2)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(p["response"]))) != 1 {
+		return "", false, false
+	}
+	if !fresh {
+		return "", false, true
+	}
+	if !a.useNonce(p["nonce"], issued, nc) {
+		return "", false, false
+	}
+	return username, true, false
+}
+
+func md5hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseDigestParams parses comma-separated list of key=value pairs where
+// value is either token or quoted string.
+func parseDigestParams(s string) map[string]string {
+	res := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return res
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return res
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		var value string
+		if strings.HasPrefix(s, "\"") {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			value = b.String()
+			if i < len(s) {
+				i++
+			}
+			s = s[i:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		res[key] = value
+	}
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type CredStore interface {
+	Verify(username, password string) bool
+}
+
+// PlainCredStore is a credential store which is able to reveal stored
+// password. It is required for Digest authentication.
+type PlainCredStore interface {
+	CredStore
+	Password(username string) (string, bool)
+}
+
+// NewCredStore instantiates credential store from specification URL.
+// Supported formats:
+//
+//	static://?username=admin&password=123456
+//	basicfile://?path=/etc/opera-proxy.htpasswd
+func NewCredStore(spec string) (CredStore, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse auth spec: %w", err)
+	}
+	values := u.Query()
+	switch strings.ToLower(u.Scheme) {
+	case "static":
+		usernames := values["username"]
+		passwords := values["password"]
+		if len(usernames) == 0 || len(usernames) != len(passwords) {
+			return nil, errors.New("static auth requires equal number of \"username\" and \"password\" parameters")
+		}
+		return NewStaticCredStore(usernames, passwords), nil
+	case "basicfile":
+		path := values.Get("path")
+		if path == "" {
+			return nil, errors.New("\"path\" parameter is missing from basicfile auth spec")
+		}
+		return NewHtpasswdCredStore(path)
+	default:
+		return nil, fmt.Errorf("unknown auth scheme %q", u.Scheme)
+	}
+}
+
+type StaticCredStore struct {
+	creds map[string]string
+}
+
+func NewStaticCredStore(usernames, passwords []string) *StaticCredStore {
+	creds := make(map[string]string, len(usernames))
+	for i, username := range usernames {
+		creds[username] = passwords[i]
+	}
+	return &StaticCredStore{
+		creds: creds,
+	}
+}
+
+func (s *StaticCredStore) Verify(username, password string) bool {
+	stored, ok := s.creds[username]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+func (s *StaticCredStore) Password(username string) (string, bool) {
+	password, ok := s.creds[username]
+	return password, ok
+}
+
+type HtpasswdCredStore struct {
+	hashes map[string][]byte
+}
+
+// NewHtpasswdCredStore loads htpasswd-style file with bcrypt password hashes.
+// Such file may be produced with `htpasswd -B` command.
+func NewHtpasswdCredStore(filename string) (*HtpasswdCredStore, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open password file %q: %w", filename, err)
+	}
+	defer f.Close()
+
+	hashes := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("bad line %d in password file %q: no separator", lineNo, filename)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("bad line %d in password file %q: %w", lineNo, filename, err)
+		}
+		hashes[username] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read password file %q: %w", filename, err)
+	}
+	return &HtpasswdCredStore{
+		hashes: hashes,
+	}, nil
+}
+
+func (s *HtpasswdCredStore) Verify(username, password string) bool {
+	hash, ok := s.hashes[username]
+	if !ok {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+type mappedCredStore struct {
+	store       CredStore
+	mapUsername func(string) string
+}
+
+// NewMappedCredStore returns store which checks credentials against store
+// after transforming username with mapUsername. It allows clients to pass
+// options in username. Returned store implements PlainCredStore if store
+// does.
+func NewMappedCredStore(store CredStore, mapUsername func(string) string) CredStore {
+	mapped := mappedCredStore{
+		store:       store,
+		mapUsername: mapUsername,
+	}
+	if plain, ok := store.(PlainCredStore); ok {
+		return mappedPlainCredStore{
+			mappedCredStore: mapped,
+			plain:           plain,
+		}
+	}
+	return mapped
+}
+
+func (s mappedCredStore) Verify(username, password string) bool {
+	return s.store.Verify(s.mapUsername(username), password)
+}
+
+type mappedPlainCredStore struct {
+	mappedCredStore
+	plain PlainCredStore
+}
+
+func (s mappedPlainCredStore) Password(username string) (string, bool) {
+	return s.plain.Password(s.mapUsername(username))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/json"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Snawoot/opera-proxy/dialer"
+	clog "github.com/Snawoot/opera-proxy/log"
+	se "github.com/Snawoot/opera-proxy/seclient"
+)
+
+const (
+	BENCH_FORMAT_CSV  = "csv"
+	BENCH_FORMAT_JSON = "json"
+)
+
+// endpointBench holds averages of successful probes of endpoint.
+type endpointBench struct {
+	IP             string  `json:"ip"`
+	Port           uint16  `json:"port"`
+	Samples        int     `json:"samples"`
+	Errors         int     `json:"errors"`
+	TLSHandshakeMs float64 `json:"tls_handshake_ms"`
+	ConnectMs      float64 `json:"connect_ms"`
+	TTFBMs         float64 `json:"ttfb_ms"`
+	Throughput     float64 `json:"throughput_bytes_per_second"`
+	LastError      string  `json:"last_error,omitempty"`
+}
+
+type benchOptions struct {
+	samples   int
+	url       string
+	dlLimit   int64
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	format    string
+}
+
+// benchEndpoints probes every port of every endpoint one after another, so
+// probes don't compete for bandwidth, and prints results to stdout.
+func benchEndpoints(ips []se.SEIPEntry, dialerFactory func(endpointAddr string) dialer.ContextDialer,
+	opts benchOptions, logger *clog.CondLogger) int {
+	var results []endpointBench
+	for _, ip := range ips {
+		ports := ip.Ports
+		if len(ports) == 0 {
+			ports = []uint16{443}
+		}
+		for _, port := range ports {
+			addr := net.JoinHostPort(ip.IP, strconv.Itoa(int(port)))
+			logger.Info("Benchmarking endpoint %s...", addr)
+			results = append(results, benchEndpoint(ip.IP, port, dialerFactory(addr), opts))
+		}
+	}
+
+	switch opts.format {
+	case BENCH_FORMAT_JSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			logger.Critical("Unable to write benchmark results: %v", err)
+			return 24
+		}
+	default:
+		wr := csv.NewWriter(os.Stdout)
+		defer wr.Flush()
+		wr.Write([]string{"ip", "port", "samples", "errors", "tls_handshake_ms", "connect_ms", "ttfb_ms",
+			"throughput_bytes_per_second", "last_error"})
+		for _, r := range results {
+			wr.Write([]string{
+				r.IP,
+				strconv.Itoa(int(r.Port)),
+				strconv.Itoa(r.Samples),
+				strconv.Itoa(r.Errors),
+				strconv.FormatFloat(r.TLSHandshakeMs, 'f', 2, 64),
+				strconv.FormatFloat(r.ConnectMs, 'f', 2, 64),
+				strconv.FormatFloat(r.TTFBMs, 'f', 2, 64),
+				strconv.FormatFloat(r.Throughput, 'f', 0, 64),
+				r.LastError,
+			})
+		}
+	}
+	return 0
+}
+
+func benchEndpoint(ip string, port uint16, d dialer.ContextDialer, opts benchOptions) endpointBench {
+	res := endpointBench{
+		IP:      ip,
+		Port:    port,
+		Samples: opts.samples,
+	}
+	var (
+		sum dialer.ProbeResult
+		ok  int
+	)
+	for i := 0; i < opts.samples; i++ {
+		ctx, cl := context.WithTimeout(context.Background(), opts.timeout)
+		probe, err := dialer.ProbeDialer(ctx, d, opts.url, opts.dlLimit, opts.tlsConfig)
+		cl()
+		if err != nil {
+			res.Errors++
+			res.LastError = err.Error()
+			continue
+		}
+		sum.TLSHandshake += probe.TLSHandshake
+		sum.Connect += probe.Connect
+		sum.TTFB += probe.TTFB
+		sum.Duration += probe.Duration
+		sum.Bytes += probe.Bytes
+		ok++
+	}
+	if ok == 0 {
+		return res
+	}
+	res.TLSHandshakeMs = milliseconds(sum.TLSHandshake) / float64(ok)
+	res.ConnectMs = milliseconds(sum.Connect) / float64(ok)
+	res.TTFBMs = milliseconds(sum.TTFB) / float64(ok)
+	res.Throughput = sum.Throughput()
+	return res
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	clog "github.com/Snawoot/opera-proxy/log"
+	se "github.com/Snawoot/opera-proxy/seclient"
+)
+
+const DISCOVERY_CACHE_FILE_MODE = 0644
+
+// discoverer provides endpoint discovery and list of countries.
+type discoverer interface {
+	Discover(ctx context.Context, requestedGeo string) ([]se.SEIPEntry, error)
+	GeoList(ctx context.Context) ([]se.SEGeoEntry, error)
+}
+
+type cachedDiscover struct {
+	UpdatedAt time.Time      `json:"updated_at"`
+	IPs       []se.SEIPEntry `json:"ips"`
+}
+
+type cachedGeoList struct {
+	UpdatedAt time.Time       `json:"updated_at"`
+	Geos      []se.SEGeoEntry `json:"geos"`
+}
+
+type discoveryCacheData struct {
+	GeoList  *cachedGeoList            `json:"geo_list,omitempty"`
+	Discover map[string]cachedDiscover `json:"discover"`
+}
+
+// discoveryCache keeps last discovery results on disk, so opera-proxy can
+// start when API is slow or unavailable. During startup results fresher
+// than ttl are used without API request and stale results are used only if
+// API request fails. Once startup is over, every call goes to API and only
+// its result is saved.
+type discoveryCache struct {
+	filename     string
+	ttl          time.Duration
+	next         discoverer
+	logger       *clog.CondLogger
+	started      atomic.Bool
+	discoverUsed atomic.Bool
+	geoListUsed  atomic.Bool
+	mux          sync.Mutex
+	saveMux      sync.Mutex
+	data         discoveryCacheData
+}
+
+func newDiscoveryCache(filename string, ttl time.Duration, next discoverer, logger *clog.CondLogger) *discoveryCache {
+	c := &discoveryCache{
+		filename: filename,
+		ttl:      ttl,
+		next:     next,
+		logger:   logger,
+	}
+	data, err := os.ReadFile(filename)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		logger.Warning("Unable to read discovery cache %s: %v", filename, err)
+	default:
+		if err := json.Unmarshal(data, &c.data); err != nil {
+			logger.Warning("Unable to parse discovery cache %s: %v", filename, err)
+			c.data = discoveryCacheData{}
+		}
+	}
+	if c.data.Discover == nil {
+		c.data.Discover = make(map[string]cachedDiscover)
+	}
+	return c
+}
+
+// EndStartup makes all further calls go to API. It reports whether
+// endpoints and country list were served from cache during startup, so
+// caller can refresh them.
+func (c *discoveryCache) EndStartup() (discoverUsed, geoListUsed bool) {
+	c.started.Store(true)
+	return c.discoverUsed.Load(), c.geoListUsed.Load()
+}
+
+func (c *discoveryCache) Discover(ctx context.Context, requestedGeo string) ([]se.SEIPEntry, error) {
+	if c.started.Load() {
+		return c.discover(ctx, requestedGeo)
+	}
+	c.mux.Lock()
+	entry, ok := c.data.Discover[requestedGeo]
+	c.mux.Unlock()
+	if ok && time.Since(entry.UpdatedAt) < c.ttl {
+		c.logger.Info("Using cached endpoints for %s discovered at %s.", requestedGeo, entry.UpdatedAt.Format(time.RFC3339))
+		c.discoverUsed.Store(true)
+		return entry.IPs, nil
+	}
+	ips, err := c.discover(ctx, requestedGeo)
+	if err != nil && ok {
+		c.logger.Warning("Discovery failed: %v. Using cached endpoints for %s discovered at %s.",
+			err, requestedGeo, entry.UpdatedAt.Format(time.RFC3339))
+		c.discoverUsed.Store(true)
+		return entry.IPs, nil
+	}
+	return ips, err
+}
+
+func (c *discoveryCache) discover(ctx context.Context, requestedGeo string) ([]se.SEIPEntry, error) {
+	ips, err := c.next.Discover(ctx, requestedGeo)
+	if err != nil {
+		return nil, err
+	}
+	// Empty list is an error for callers, so it isn't worth caching
+	if len(ips) > 0 {
+		c.mux.Lock()
+		c.data.Discover[requestedGeo] = cachedDiscover{
+			UpdatedAt: time.Now(),
+			IPs:       ips,
+		}
+		c.mux.Unlock()
+		c.save()
+	}
+	return ips, nil
+}
+
+func (c *discoveryCache) GeoList(ctx context.Context) ([]se.SEGeoEntry, error) {
+	if c.started.Load() {
+		return c.geoList(ctx)
+	}
+	c.mux.Lock()
+	entry := c.data.GeoList
+	c.mux.Unlock()
+	if entry != nil && time.Since(entry.UpdatedAt) < c.ttl {
+		c.logger.Info("Using cached country list updated at %s.", entry.UpdatedAt.Format(time.RFC3339))
+		c.geoListUsed.Store(true)
+		return entry.Geos, nil
+	}
+	geos, err := c.geoList(ctx)
+	if err != nil && entry != nil {
+		c.logger.Warning("Country list request failed: %v. Using cached country list updated at %s.",
+			err, entry.UpdatedAt.Format(time.RFC3339))
+		c.geoListUsed.Store(true)
+		return entry.Geos, nil
+	}
+	return geos, err
+}
+
+func (c *discoveryCache) geoList(ctx context.Context) ([]se.SEGeoEntry, error) {
+	geos, err := c.next.GeoList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.mux.Lock()
+	c.data.GeoList = &cachedGeoList{
+		UpdatedAt: time.Now(),
+		Geos:      geos,
+	}
+	c.mux.Unlock()
+	c.save()
+	return geos, nil
+}
+
+func (c *discoveryCache) save() {
+	// Saves are serialized, so older snapshot can't replace newer one
+	c.saveMux.Lock()
+	defer c.saveMux.Unlock()
+	c.mux.Lock()
+	data, err := json.MarshalIndent(c.data, "", "  ")
+	c.mux.Unlock()
+	if err == nil {
+		err = writeFileAtomic(c.filename, data, DISCOVERY_CACHE_FILE_MODE)
+	}
+	if err != nil {
+		c.logger.Error("Unable to save discovery cache %s: %v", c.filename, err)
+	}
+}
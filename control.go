@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/Snawoot/opera-proxy/dialer"
+	"github.com/Snawoot/opera-proxy/handler"
+	clog "github.com/Snawoot/opera-proxy/log"
+	"github.com/Snawoot/opera-proxy/metrics"
+	se "github.com/Snawoot/opera-proxy/seclient"
+)
+
+// endpointSelector discovers endpoints for country and picks one of them.
+// Discovered endpoints replace ones previously registered for health
+// checks under group name.
+type endpointSelector = func(ctx context.Context, country, group string) (dialer.ContextDialer, string, error)
+
+// DEFAULT_ENDPOINT_GROUP names endpoints used by connections without
+// requested country. Endpoints for requested countries are grouped by
+// country code.
+const DEFAULT_ENDPOINT_GROUP = "default"
+
+// tunnelController owns current upstream endpoint and proxy credentials
+// and implements runtime control operations of admin API. New endpoint is
+// installed into switch dialer, so existing tunnels keep running through
+// previous endpoint until closed.
+type tunnelController struct {
+	opMux         sync.Mutex
+	stateMux      sync.RWMutex
+	seclient      *se.SEClient
+	dialer        *dialer.SwitchDialer
+	countries     *dialer.CountryDialer
+	selector      endpointSelector
+	known         *countryList
+	fixedEndpoint bool
+	timeout       time.Duration
+	stateFile     string
+	logger        *clog.CondLogger
+	hooksMux      sync.Mutex
+	switchHooks   []func()
+
+	country          string
+	endpoint         string
+	startedAt        time.Time
+	credsRefreshedAt time.Time
+}
+
+func newTunnelController(seclient *se.SEClient, d *dialer.SwitchDialer, countries *dialer.CountryDialer, selector endpointSelector,
+	known *countryList, country, endpoint string, fixedEndpoint bool, timeout time.Duration, stateFile string, logger *clog.CondLogger) *tunnelController {
+	now := time.Now()
+	return &tunnelController{
+		seclient:         seclient,
+		dialer:           d,
+		countries:        countries,
+		selector:         selector,
+		known:            known,
+		fixedEndpoint:    fixedEndpoint,
+		timeout:          timeout,
+		stateFile:        stateFile,
+		logger:           logger,
+		country:          country,
+		endpoint:         endpoint,
+		startedAt:        now,
+		credsRefreshedAt: now,
+	}
+}
+
+// OnEndpointSwitch registers hook called after endpoint of any country is
+// switched.
+func (c *tunnelController) OnEndpointSwitch(hook func()) {
+	c.hooksMux.Lock()
+	defer c.hooksMux.Unlock()
+	c.switchHooks = append(c.switchHooks, hook)
+}
+
+func (c *tunnelController) endpointSwitched() {
+	c.hooksMux.Lock()
+	hooks := append([]func(){}, c.switchHooks...)
+	c.hooksMux.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+}
+
+func (c *tunnelController) Status() handler.AdminStatus {
+	c.stateMux.RLock()
+	defer c.stateMux.RUnlock()
+	now := time.Now()
+	return handler.AdminStatus{
+		Country:                c.country,
+		Endpoint:               c.endpoint,
+		EndpointFixed:          c.fixedEndpoint,
+		CredentialsRefreshedAt: c.credsRefreshedAt,
+		CredentialsAge:         now.Sub(c.credsRefreshedAt).Seconds(),
+		StartedAt:              c.startedAt,
+		Uptime:                 now.Sub(c.startedAt).Seconds(),
+	}
+}
+
+// RefreshCredentials renews login and proxy credentials.
+func (c *tunnelController) RefreshCredentials(ctx context.Context) error {
+	c.opMux.Lock()
+	defer c.opMux.Unlock()
+
+	c.logger.Info("Refreshing login...")
+	reqCtx, cl := context.WithTimeout(ctx, c.timeout)
+	defer cl()
+	err := c.seclient.Login(reqCtx)
+	if err != nil {
+		c.logger.Error("Login refresh failed: %v", err)
+		metrics.LoginRefreshes.WithLabelValues(metrics.ResultError).Inc()
+		return err
+	}
+	c.logger.Info("Login refreshed.")
+
+	c.logger.Info("Refreshing device password...")
+	reqCtx, cl = context.WithTimeout(ctx, c.timeout)
+	defer cl()
+	err = c.seclient.DeviceGeneratePassword(reqCtx)
+	if err != nil {
+		c.logger.Error("Device password refresh failed: %v", err)
+		metrics.LoginRefreshes.WithLabelValues(metrics.ResultError).Inc()
+		return err
+	}
+	c.logger.Info("Device password refreshed.")
+	metrics.LoginRefreshes.WithLabelValues(metrics.ResultSuccess).Inc()
+
+	c.stateMux.Lock()
+	c.credsRefreshedAt = time.Now()
+	c.stateMux.Unlock()
+
+	if c.stateFile != "" {
+		if err := saveClientState(c.stateFile, c.seclient); err != nil {
+			c.logger.Error("Unable to save state file %s: %v", c.stateFile, err)
+		}
+	}
+	return nil
+}
+
+// Rediscover runs discovery and server selection for current country, if
+// it is in use, and for countries requested by clients.
+func (c *tunnelController) Rediscover(ctx context.Context) error {
+	if c.fixedEndpoint {
+		return fmt.Errorf("endpoint is fixed by -override-proxy-address: %w", handler.ErrAdminConflict)
+	}
+	c.opMux.Lock()
+	defer c.opMux.Unlock()
+
+	c.stateMux.RLock()
+	country, endpoint := c.country, c.endpoint
+	c.stateMux.RUnlock()
+	var resErr error
+	// Endpoint for default country isn't selected if no listener uses it,
+	// unless it was requested with SetCountry.
+	if endpoint != "" {
+		if err := c.setCountry(ctx, country); err != nil {
+			resErr = multierror.Append(resErr, err)
+		}
+	}
+	for _, country := range c.countries.Countries() {
+		d, endpoint, err := c.selector(ctx, country, country)
+		if err != nil {
+			resErr = multierror.Append(resErr, fmt.Errorf("endpoint selection for country %q failed: %w", country, err))
+			continue
+		}
+		prevEndpoint := dialerAddress(c.countries.Replace(country, d))
+		if prevEndpoint == endpoint {
+			c.logger.Info("Endpoint %s is still selected for country %s.", endpoint, country)
+		} else {
+			c.logger.Info("Switched country %s from endpoint %s to %s. Existing tunnels are left to drain.",
+				country, prevEndpoint, endpoint)
+			c.endpointSwitched()
+		}
+	}
+	return resErr
+}
+
+// SetCountry runs discovery and server selection for country and switches
+// new connections to selected endpoint.
+func (c *tunnelController) SetCountry(ctx context.Context, country string) error {
+	if c.fixedEndpoint {
+		return fmt.Errorf("endpoint is fixed by -override-proxy-address: %w", handler.ErrAdminConflict)
+	}
+	known, err := c.known.Known(ctx, country)
+	if err != nil {
+		return fmt.Errorf("unable to check country %q: %w", country, err)
+	}
+	if !known {
+		return fmt.Errorf("country %q is not offered by API: %w", country, handler.ErrAdminBadRequest)
+	}
+	c.opMux.Lock()
+	defer c.opMux.Unlock()
+	return c.setCountry(ctx, country)
+}
+
+func (c *tunnelController) setCountry(ctx context.Context, country string) error {
+	d, endpoint, err := c.selector(ctx, country, DEFAULT_ENDPOINT_GROUP)
+	if err != nil {
+		return fmt.Errorf("endpoint selection for country %q failed: %w", country, err)
+	}
+	c.dialer.Set(d)
+	metrics.SetSelectedEndpoint(endpoint)
+
+	c.stateMux.Lock()
+	prevCountry, prevEndpoint := c.country, c.endpoint
+	c.country, c.endpoint = country, endpoint
+	c.stateMux.Unlock()
+	if prevCountry == country && prevEndpoint == endpoint {
+		c.logger.Info("Endpoint %s is still selected for country %s.", endpoint, country)
+	} else {
+		c.logger.Info("Switched from endpoint %s (%s) to %s (%s). Existing tunnels are left to drain.",
+			prevEndpoint, prevCountry, endpoint, country)
+		// Pooled connections of forwarded requests would keep using
+		// previous endpoint.
+		c.endpointSwitched()
+	}
+	return nil
+}
+
+func dialerAddress(d dialer.ContextDialer) string {
+	if addresser, ok := d.(interface{ Address() (string, error) }); ok {
+		if addr, err := addresser.Address(); err == nil {
+			return addr
+		}
+	}
+	return ""
+}
@@ -0,0 +1,219 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const BALANCER_RING_REPLICAS = 128
+
+type BalancePolicy int
+
+const (
+	BalanceNone BalancePolicy = iota
+	BalanceRoundRobin
+	BalanceLeastConn
+	BalanceConsistentHash
+)
+
+func (p BalancePolicy) String() string {
+	switch p {
+	case BalanceNone:
+		return "none"
+	case BalanceRoundRobin:
+		return "round-robin"
+	case BalanceLeastConn:
+		return "least-conn"
+	case BalanceConsistentHash:
+		return "consistent-hash"
+	default:
+		return fmt.Sprintf("BalancePolicy(%d)", int(p))
+	}
+}
+
+func ParseBalancePolicy(s string) (BalancePolicy, error) {
+	switch strings.ToLower(s) {
+	case "none", "":
+		return BalanceNone, nil
+	case "round-robin":
+		return BalanceRoundRobin, nil
+	case "least-conn":
+		return BalanceLeastConn, nil
+	case "consistent-hash":
+		return BalanceConsistentHash, nil
+	}
+	return 0, errors.New("unknown balancing policy")
+}
+
+type ringPoint struct {
+	hash uint64
+	idx  int
+}
+
+// BalancingDialer spreads connections across dialers according to policy:
+//
+//	round-robin     - dialers are used in turn
+//	least-conn      - dialer with fewest active connections is used
+//	consistent-hash - destination host is mapped to the same dialer as long
+//	                  as set of dialers doesn't change
+//
+// If chosen dialer fails, other dialers are tried in order defined by
+// policy. Dialers reported unhealthy are tried last.
+type BalancingDialer struct {
+	dialers []ContextDialer
+	policy  BalancePolicy
+	next    atomic.Uint64
+	active  []atomic.Int64
+	ring    []ringPoint
+}
+
+func NewBalancingDialer(dialers []ContextDialer, policy BalancePolicy) *BalancingDialer {
+	d := &BalancingDialer{
+		dialers: dialers,
+		policy:  policy,
+		active:  make([]atomic.Int64, len(dialers)),
+	}
+	if policy == BalanceConsistentHash {
+		d.ring = make([]ringPoint, 0, len(dialers)*BALANCER_RING_REPLICAS)
+		for i, dialer := range dialers {
+			key, err := dialerAddress(dialer)
+			if err != nil {
+				key = strconv.Itoa(i)
+			}
+			for r := 0; r < BALANCER_RING_REPLICAS; r++ {
+				d.ring = append(d.ring, ringPoint{
+					hash: hashString(key + "#" + strconv.Itoa(r)),
+					idx:  i,
+				})
+			}
+		}
+		sort.Slice(d.ring, func(a, b int) bool {
+			return d.ring[a].hash < d.ring[b].hash
+		})
+	}
+	return d
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// FNV spreads similar short keys poorly, so mix bits with
+	// splitmix64 finalizer.
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+func dialerAddress(d ContextDialer) (string, error) {
+	if addresser, ok := d.(interface{ Address() (string, error) }); ok {
+		return addresser.Address()
+	}
+	return "", errors.New("dialer doesn't expose its address")
+}
+
+// order returns indexes of dialers in order they should be tried for
+// destination address.
+func (d *BalancingDialer) order(address string) []int {
+	n := len(d.dialers)
+	res := make([]int, 0, n)
+	switch d.policy {
+	case BalanceConsistentHash:
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		h := hashString(strings.ToLower(host))
+		start := sort.Search(len(d.ring), func(i int) bool {
+			return d.ring[i].hash >= h
+		})
+		seen := make([]bool, n)
+		for i := 0; i < len(d.ring) && len(res) < n; i++ {
+			p := d.ring[(start+i)%len(d.ring)]
+			if !seen[p.idx] {
+				seen[p.idx] = true
+				res = append(res, p.idx)
+			}
+		}
+	default:
+		start := int((d.next.Add(1) - 1) % uint64(n))
+		for i := 0; i < n; i++ {
+			res = append(res, (start+i)%n)
+		}
+		if d.policy == BalanceLeastConn {
+			// Rotation above breaks ties between equally loaded dialers.
+			sort.SliceStable(res, func(a, b int) bool {
+				return d.active[res[a]].Load() < d.active[res[b]].Load()
+			})
+		}
+	}
+	// Endpoints marked down by health checks are tried last
+	sort.SliceStable(res, func(a, b int) bool {
+		return isHealthy(d.dialers[res[a]]) && !isHealthy(d.dialers[res[b]])
+	})
+	return res
+}
+
+func (d *BalancingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if len(d.dialers) == 0 {
+		return nil, errors.New("empty dialers list")
+	}
+	var resErr error
+	for _, i := range d.order(address) {
+		conn, err := d.dialers[i].DialContext(ctx, network, address)
+		if err == nil {
+			if d.policy == BalanceLeastConn {
+				d.active[i].Add(1)
+				conn = &trackedConn{
+					Conn: conn,
+					done: func() { d.active[i].Add(-1) },
+				}
+			}
+			return conn, nil
+		}
+		resErr = multierror.Append(resErr, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, resErr
+}
+
+func (d *BalancingDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// Address returns comma-separated addresses of all dialers.
+func (d *BalancingDialer) Address() (string, error) {
+	addrs := make([]string, 0, len(d.dialers))
+	for _, dialer := range d.dialers {
+		addr, err := dialerAddress(dialer)
+		if err != nil {
+			return "", err
+		}
+		addrs = append(addrs, addr)
+	}
+	return strings.Join(addrs, ","), nil
+}
+
+// trackedConn calls done once when connection is closed.
+type trackedConn struct {
+	net.Conn
+	once sync.Once
+	done func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.done)
+	return c.Conn.Close()
+}
@@ -0,0 +1,177 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type countryKey struct{}
+
+// WithCountry returns context requesting connections made with it to exit
+// in specified country.
+func WithCountry(ctx context.Context, country string) context.Context {
+	return context.WithValue(ctx, countryKey{}, strings.ToUpper(country))
+}
+
+// CountryFromContext returns country requested by WithCountry.
+func CountryFromContext(ctx context.Context) (string, bool) {
+	country, ok := ctx.Value(countryKey{}).(string)
+	return country, ok && country != ""
+}
+
+// CountryDialerFactory builds dialer for connections exiting in country.
+type CountryDialerFactory = func(ctx context.Context, country string) (ContextDialer, error)
+
+type countryDialerEntry struct {
+	ready    chan struct{}
+	dialer   ContextDialer
+	err      error
+	failedAt time.Time
+}
+
+// expired reports whether failed build may be retried. It must be called
+// after entry is ready.
+func (e *countryDialerEntry) expired(failureTTL time.Duration) bool {
+	return e.err != nil && time.Since(e.failedAt) >= failureTTL
+}
+
+// CountryDialer dispatches connections to per-country dialers according to
+// country requested in dial context. Dialers are built on first use and
+// reused afterwards. Connections without requested country go to default
+// dialer.
+type CountryDialer struct {
+	def        ContextDialer
+	factory    CountryDialerFactory
+	failureTTL time.Duration
+	mux        sync.Mutex
+	dialers    map[string]*countryDialerEntry
+}
+
+func NewCountryDialer(def ContextDialer, factory CountryDialerFactory, failureTTL time.Duration) *CountryDialer {
+	return &CountryDialer{
+		def:        def,
+		factory:    factory,
+		failureTTL: failureTTL,
+		dialers:    make(map[string]*countryDialerEntry),
+	}
+}
+
+// ForCountry returns dialer for country, building it if necessary.
+// Failed build is remembered for failureTTL, so requests for country which
+// can't be served don't trigger new build every time.
+func (d *CountryDialer) ForCountry(ctx context.Context, country string) (ContextDialer, error) {
+	d.mux.Lock()
+	entry, ok := d.dialers[country]
+	if ok {
+		select {
+		case <-entry.ready:
+			ok = !entry.expired(d.failureTTL)
+		default:
+		}
+	}
+	if !ok {
+		entry = &countryDialerEntry{
+			ready: make(chan struct{}),
+		}
+		d.dialers[country] = entry
+		d.mux.Unlock()
+		// Build is shared by all waiters, so it shouldn't be cancelled
+		// together with context of first caller.
+		entry.dialer, entry.err = d.factory(context.WithoutCancel(ctx), country)
+		if entry.err != nil {
+			entry.failedAt = time.Now()
+		}
+		close(entry.ready)
+	} else {
+		d.mux.Unlock()
+	}
+	select {
+	case <-entry.ready:
+		return entry.dialer, entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Countries returns list of countries with ready dialers.
+func (d *CountryDialer) Countries() []string {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	res := make([]string, 0, len(d.dialers))
+	for country, entry := range d.dialers {
+		select {
+		case <-entry.ready:
+			if entry.err == nil {
+				res = append(res, country)
+			}
+		default:
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Replace installs dialer for country and returns previous one, if any.
+// Connections made with previous dialer are not affected.
+func (d *CountryDialer) Replace(country string, next ContextDialer) ContextDialer {
+	entry := &countryDialerEntry{
+		ready:  make(chan struct{}),
+		dialer: next,
+	}
+	close(entry.ready)
+	d.mux.Lock()
+	prev, ok := d.dialers[country]
+	d.dialers[country] = entry
+	d.mux.Unlock()
+	if !ok {
+		return nil
+	}
+	select {
+	case <-prev.ready:
+		return prev.dialer
+	default:
+		return nil
+	}
+}
+
+func (d *CountryDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	country, ok := CountryFromContext(ctx)
+	if !ok {
+		return d.def.DialContext(ctx, network, address)
+	}
+	next, err := d.ForCountry(ctx, country)
+	if err != nil {
+		return nil, err
+	}
+	return next.DialContext(ctx, network, address)
+}
+
+func (d *CountryDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// PinnedCountryDialer requests the same country for all connections,
+// overriding country requested by client.
+type PinnedCountryDialer struct {
+	country string
+	next    ContextDialer
+}
+
+func NewPinnedCountryDialer(country string, next ContextDialer) *PinnedCountryDialer {
+	return &PinnedCountryDialer{
+		country: country,
+		next:    next,
+	}
+}
+
+func (d *PinnedCountryDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.next.DialContext(WithCountry(ctx, d.country), network, address)
+}
+
+func (d *PinnedCountryDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
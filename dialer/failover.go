@@ -0,0 +1,111 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/Snawoot/opera-proxy/metrics"
+)
+
+// FailoverDialer tries dialers in order until one of them succeeds. Dialer
+// which failed is put on cooldown and is tried only after all healthy
+// dialers, so clients get error only if every dialer failed. Failure to
+// reach destination reported by upstream proxy (502 or 504 response) is
+// returned as is.
+type FailoverDialer struct {
+	dialers   []ContextDialer
+	cooldown  time.Duration
+	mux       sync.Mutex
+	downUntil []time.Time
+}
+
+// NewFailoverDialer returns failover dialer. First dialer is preferred
+// whenever it is not on cooldown.
+func NewFailoverDialer(dialers []ContextDialer, cooldown time.Duration) *FailoverDialer {
+	return &FailoverDialer{
+		dialers:   dialers,
+		cooldown:  cooldown,
+		downUntil: make([]time.Time, len(dialers)),
+	}
+}
+
+// order returns indexes of dialers: healthy ones in original order followed
+// by ones on cooldown or marked down by health checks, sooner to recover
+// first.
+func (d *FailoverDialer) order() []int {
+	now := time.Now()
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	var healthy, down []int
+	for i, until := range d.downUntil {
+		if now.Before(until) || !isHealthy(d.dialers[i]) {
+			down = append(down, i)
+		} else {
+			healthy = append(healthy, i)
+		}
+	}
+	sort.SliceStable(down, func(a, b int) bool {
+		return d.downUntil[down[a]].Before(d.downUntil[down[b]])
+	})
+	return append(healthy, down...)
+}
+
+func (d *FailoverDialer) markDown(i int) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.downUntil[i] = time.Now().Add(d.cooldown)
+}
+
+func (d *FailoverDialer) markUp(i int) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.downUntil[i] = time.Time{}
+}
+
+func (d *FailoverDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if len(d.dialers) == 0 {
+		return nil, errors.New("empty dialers list")
+	}
+	var resErr error
+	for attempt, i := range d.order() {
+		if attempt > 0 {
+			metrics.EndpointFailovers.Inc()
+		}
+		conn, err := d.dialers[i].DialContext(ctx, network, address)
+		if err == nil {
+			d.markUp(i)
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			// Failure caused by client going away says nothing about
+			// endpoint health.
+			return nil, err
+		}
+		if destinationError(err) {
+			// Endpoint is fine, but destination can't be reached. Other
+			// endpoints would get the same answer.
+			return nil, err
+		}
+		d.markDown(i)
+		resErr = multierror.Append(resErr, err)
+	}
+	return nil, resErr
+}
+
+func (d *FailoverDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// Address returns address of preferred dialer.
+func (d *FailoverDialer) Address() (string, error) {
+	if len(d.dialers) == 0 {
+		return "", errors.New("empty dialers list")
+	}
+	return dialerAddress(d.dialers[0])
+}
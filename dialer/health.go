@@ -0,0 +1,260 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Snawoot/opera-proxy/clock"
+)
+
+var ErrCircuitOpen = errors.New("endpoint is marked down by circuit breaker")
+
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(s))
+	}
+}
+
+// CircuitBreaker opens after threshold consecutive failures. Once
+// resetTimeout passes, it becomes half-open and lets single trial through:
+// success closes it and failure opens it again.
+type CircuitBreaker struct {
+	mux          sync.Mutex
+	threshold    int
+	resetTimeout time.Duration
+	state        CircuitState
+	failures     int
+	openedAt     time.Time
+	trial        bool
+	onChange     func(from, to CircuitState)
+}
+
+// NewCircuitBreaker returns circuit breaker in closed state. onChange is
+// called on every state transition unless it is nil.
+func NewCircuitBreaker(threshold int, resetTimeout time.Duration, onChange func(from, to CircuitState)) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &CircuitBreaker{
+		threshold:    threshold,
+		resetTimeout: resetTimeout,
+		onChange:     onChange,
+	}
+}
+
+// setState must be called with mutex held. It returns function notifying
+// about transition which must be called after mutex is released.
+func (b *CircuitBreaker) setState(state CircuitState) func() {
+	from := b.state
+	b.state = state
+	if from == state || b.onChange == nil {
+		return func() {}
+	}
+	return func() { b.onChange(from, state) }
+}
+
+// Allow reports whether operation may proceed. Every allowed operation must
+// be followed by call to Success, Failure or Abort.
+func (b *CircuitBreaker) Allow() bool {
+	b.mux.Lock()
+	notify := func() {}
+	defer func() {
+		b.mux.Unlock()
+		notify()
+	}()
+	if b.state == CircuitOpen && time.Since(b.openedAt) >= b.resetTimeout {
+		notify = b.setState(CircuitHalfOpen)
+	}
+	switch b.state {
+	case CircuitClosed:
+		return true
+	case CircuitHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+	return false
+}
+
+func (b *CircuitBreaker) Success() {
+	b.mux.Lock()
+	b.failures = 0
+	b.trial = false
+	notify := b.setState(CircuitClosed)
+	b.mux.Unlock()
+	notify()
+}
+
+func (b *CircuitBreaker) Failure() {
+	b.mux.Lock()
+	b.failures++
+	notify := func() {}
+	if b.state == CircuitHalfOpen || b.failures >= b.threshold {
+		b.trial = false
+		b.openedAt = time.Now()
+		notify = b.setState(CircuitOpen)
+	}
+	b.mux.Unlock()
+	notify()
+}
+
+// Abort releases operation which completed without telling anything about
+// health, for example cancelled by client.
+func (b *CircuitBreaker) Abort() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.trial = false
+}
+
+func (b *CircuitBreaker) State() CircuitState {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.state
+}
+
+// HealthCheckedDialer guards endpoint dialer with circuit breaker fed by
+// both client connections and active probes.
+type HealthCheckedDialer struct {
+	next    ContextDialer
+	breaker *CircuitBreaker
+}
+
+func NewHealthCheckedDialer(next ContextDialer, breaker *CircuitBreaker) *HealthCheckedDialer {
+	return &HealthCheckedDialer{
+		next:    next,
+		breaker: breaker,
+	}
+}
+
+func (d *HealthCheckedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dial(ctx, network, address, false)
+}
+
+// dial counts only failures of endpoint itself: connection and TLS errors,
+// rejected credentials and malformed responses. Destination unreachable
+// through working endpoint doesn't count, neither does deadline of client
+// connection. Deadline of probe is set by health checker, so probe timeout
+// counts.
+func (d *HealthCheckedDialer) dial(ctx context.Context, network, address string, probe bool) (net.Conn, error) {
+	if !d.breaker.Allow() {
+		endpoint, _ := dialerAddress(d.next)
+		return nil, fmt.Errorf("endpoint %s: %w", endpoint, ErrCircuitOpen)
+	}
+	conn, err := d.next.DialContext(ctx, network, address)
+	switch {
+	case err == nil:
+		d.breaker.Success()
+	case errors.Is(ctx.Err(), context.Canceled),
+		ctx.Err() != nil && !probe,
+		destinationError(err):
+		d.breaker.Abort()
+	default:
+		d.breaker.Failure()
+	}
+	return conn, err
+}
+
+func (d *HealthCheckedDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// Healthy reports whether endpoint circuit is closed.
+func (d *HealthCheckedDialer) Healthy() bool {
+	return d.breaker.State() == CircuitClosed
+}
+
+func (d *HealthCheckedDialer) Address() (string, error) {
+	return dialerAddress(d.next)
+}
+
+// Probe checks endpoint by establishing tunnel to target and closing it.
+// Probe is skipped while circuit is open.
+func (d *HealthCheckedDialer) Probe(ctx context.Context, target string) error {
+	conn, err := d.dial(ctx, "tcp", target, true)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func isHealthy(d ContextDialer) bool {
+	h, ok := d.(interface{ Healthy() bool })
+	return !ok || h.Healthy()
+}
+
+// HealthChecker periodically probes groups of endpoints. Groups are named,
+// so group can be replaced when endpoints are rediscovered.
+type HealthChecker struct {
+	target  string
+	timeout time.Duration
+	mux     sync.Mutex
+	groups  map[string][]*HealthCheckedDialer
+}
+
+// NewHealthChecker returns health checker which probes endpoints by
+// tunneling to target address within timeout.
+func NewHealthChecker(target string, timeout time.Duration) *HealthChecker {
+	return &HealthChecker{
+		target:  target,
+		timeout: timeout,
+		groups:  make(map[string][]*HealthCheckedDialer),
+	}
+}
+
+// SetGroup replaces endpoints probed under name.
+func (h *HealthChecker) SetGroup(name string, dialers []*HealthCheckedDialer) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.groups[name] = dialers
+}
+
+// Run starts probing every interval until ctx is done.
+func (h *HealthChecker) Run(ctx context.Context, interval time.Duration) {
+	clock.RunTicker(ctx, interval, interval, func(ctx context.Context) error {
+		h.CheckAll(ctx)
+		return nil
+	})
+}
+
+// CheckAll probes all endpoints concurrently and waits for results.
+func (h *HealthChecker) CheckAll(ctx context.Context) {
+	h.mux.Lock()
+	var dialers []*HealthCheckedDialer
+	for _, group := range h.groups {
+		dialers = append(dialers, group...)
+	}
+	h.mux.Unlock()
+
+	var wg sync.WaitGroup
+	for _, d := range dialers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, h.timeout)
+			defer cancel()
+			d.Probe(probeCtx, h.target)
+		}()
+	}
+	wg.Wait()
+}
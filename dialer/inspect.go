@@ -0,0 +1,49 @@
+package dialer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// TLSInspection describes TLS session established with upstream proxy.
+type TLSInspection struct {
+	Version     uint16
+	CipherSuite uint16
+	Certificate *x509.Certificate
+	// VerifyErrors are results of certificate verification against expected
+	// server names, in the same order. Nil means certificate is valid for
+	// corresponding name.
+	VerifyErrors []error
+}
+
+// InspectTLS performs TLS handshake with upstream proxy at address the same
+// way ProxyDialer does, sending sni as SNI, and reports session parameters
+// and whether certificate is valid for each of serverNames. Nil caPool means
+// system CA pool.
+func InspectTLS(ctx context.Context, next ContextDialer, address, sni string, serverNames []string, caPool *x509.CertPool) (*TLSInspection, error) {
+	conn, err := next.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: true,
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	cs := tlsConn.ConnectionState()
+	res := &TLSInspection{
+		Version:     cs.Version,
+		CipherSuite: cs.CipherSuite,
+	}
+	for _, serverName := range serverNames {
+		res.VerifyErrors = append(res.VerifyErrors, verifyPeerCertificates(cs.PeerCertificates, serverName, caPool))
+	}
+	if len(cs.PeerCertificates) > 0 {
+		res.Certificate = cs.PeerCertificates[0]
+	}
+	return res, nil
+}
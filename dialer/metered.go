@@ -0,0 +1,43 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/Snawoot/opera-proxy/metrics"
+)
+
+// MeteredDialer records time taken to establish tunnel through upstream
+// endpoint. It wraps endpoint dialers only, so dials of base proxy aren't
+// mixed into endpoint latency.
+type MeteredDialer struct {
+	endpoint string
+	next     ContextDialer
+}
+
+func NewMeteredDialer(endpoint string, next ContextDialer) *MeteredDialer {
+	return &MeteredDialer{
+		endpoint: endpoint,
+		next:     next,
+	}
+}
+
+func (d *MeteredDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := d.next.DialContext(ctx, network, address)
+	result := metrics.ResultSuccess
+	if err != nil {
+		result = metrics.ResultError
+	}
+	metrics.UpstreamDialDuration.WithLabelValues(d.endpoint, result).Observe(time.Since(start).Seconds())
+	return conn, err
+}
+
+func (d *MeteredDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *MeteredDialer) Address() (string, error) {
+	return dialerAddress(d.next)
+}
@@ -0,0 +1,99 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/Snawoot/opera-proxy/metrics"
+)
+
+// RacingDialer establishes connection through primary dialer and, if it
+// doesn't succeed within delay, through secondary dialer as well. First
+// established connection is used and the other one is closed. Secondary
+// dialer is started immediately if primary fails before delay passes.
+type RacingDialer struct {
+	primary   ContextDialer
+	secondary ContextDialer
+	delay     time.Duration
+}
+
+func NewRacingDialer(primary, secondary ContextDialer, delay time.Duration) *RacingDialer {
+	return &RacingDialer{
+		primary:   primary,
+		secondary: secondary,
+		delay:     delay,
+	}
+}
+
+type raceResult struct {
+	conn      net.Conn
+	err       error
+	secondary bool
+}
+
+func (d *RacingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan raceResult, 2)
+	dial := func(dialer ContextDialer, secondary bool) {
+		conn, err := dialer.DialContext(raceCtx, network, address)
+		results <- raceResult{conn, err, secondary}
+	}
+
+	go dial(d.primary, false)
+	running, secondaryStarted := 1, false
+	startSecondary := func() {
+		secondaryStarted = true
+		running++
+		go dial(d.secondary, true)
+	}
+	timer := time.NewTimer(d.delay)
+	defer timer.Stop()
+
+	var resErr error
+	for running > 0 {
+		select {
+		case <-timer.C:
+			if !secondaryStarted {
+				startSecondary()
+			}
+		case res := <-results:
+			running--
+			if res.err == nil {
+				if running > 0 {
+					// Loser is cancelled by deferred cancel. Close its
+					// connection if it made it anyway.
+					go func() {
+						if loser := <-results; loser.conn != nil {
+							loser.conn.Close()
+						}
+					}()
+				}
+				if res.secondary {
+					metrics.EndpointRaces.WithLabelValues(metrics.RaceWinnerSecondary).Inc()
+				} else {
+					metrics.EndpointRaces.WithLabelValues(metrics.RaceWinnerPrimary).Inc()
+				}
+				return res.conn, nil
+			}
+			resErr = multierror.Append(resErr, res.err)
+			if !secondaryStarted && ctx.Err() == nil {
+				startSecondary()
+			}
+		}
+	}
+	metrics.EndpointRaces.WithLabelValues(metrics.RaceWinnerNone).Inc()
+	return nil, resErr
+}
+
+func (d *RacingDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// Address returns address of primary dialer.
+func (d *RacingDialer) Address() (string, error) {
+	return dialerAddress(d.primary)
+}
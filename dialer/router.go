@@ -0,0 +1,231 @@
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	OutboundTunnel = "tunnel"
+	OutboundDirect = "direct"
+	OutboundReject = "reject"
+)
+
+var ErrRejected = errors.New("connection rejected by routing rules")
+
+type routeMatcher = func(host string, port uint16) bool
+
+type RouteRule struct {
+	match    routeMatcher
+	repr     string
+	Outbound string
+}
+
+func (r RouteRule) String() string {
+	return r.repr + " " + r.Outbound
+}
+
+// ParseRouteRule constructs rule from matcher kind, matcher value and outbound
+// name. Supported matcher kinds:
+//
+//	domain        - exact hostname match
+//	domain-suffix - hostname is equal to value or is its subdomain
+//	regex         - hostname matches regular expression
+//	cidr          - IP address literal belongs to network
+//	port          - destination port is equal to value or belongs to range (e.g. 8000-8999)
+func ParseRouteRule(kind, value, outbound string) (RouteRule, error) {
+	outbound, err := parseOutbound(outbound)
+	if err != nil {
+		return RouteRule{}, err
+	}
+
+	var m routeMatcher
+	switch strings.ToLower(kind) {
+	case "domain", "host":
+		value = normalizeHost(value)
+		m = func(host string, _ uint16) bool {
+			return host == value
+		}
+	case "domain-suffix":
+		value = strings.TrimPrefix(normalizeHost(value), ".")
+		m = func(host string, _ uint16) bool {
+			return host == value || strings.HasSuffix(host, "."+value)
+		}
+	case "regex":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return RouteRule{}, fmt.Errorf("bad regex %q: %w", value, err)
+		}
+		m = func(host string, _ uint16) bool {
+			return re.MatchString(host)
+		}
+	case "cidr":
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(value)
+			if addrErr != nil {
+				return RouteRule{}, fmt.Errorf("bad CIDR %q: %w", value, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefix = prefix.Masked()
+		m = func(host string, _ uint16) bool {
+			addr, err := netip.ParseAddr(host)
+			if err != nil {
+				return false
+			}
+			return prefix.Contains(addr.Unmap())
+		}
+	case "port":
+		lo, hi, err := parsePortRange(value)
+		if err != nil {
+			return RouteRule{}, err
+		}
+		m = func(_ string, port uint16) bool {
+			return lo <= port && port <= hi
+		}
+	default:
+		return RouteRule{}, fmt.Errorf("unknown matcher %q", kind)
+	}
+	return RouteRule{
+		match:    m,
+		repr:     kind + " " + value,
+		Outbound: outbound,
+	}, nil
+}
+
+func parseOutbound(s string) (string, error) {
+	s = strings.ToLower(s)
+	switch s {
+	case OutboundTunnel, OutboundDirect, OutboundReject:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown outbound %q", s)
+}
+
+func parsePortRange(s string) (uint16, uint16, error) {
+	loStr, hiStr, isRange := strings.Cut(s, "-")
+	lo, err := strconv.ParseUint(loStr, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad port %q: %w", s, err)
+	}
+	hi := lo
+	if isRange {
+		hi, err = strconv.ParseUint(hiStr, 10, 16)
+		if err != nil {
+			return 0, 0, fmt.Errorf("bad port %q: %w", s, err)
+		}
+	}
+	if lo > hi {
+		return 0, 0, fmt.Errorf("bad port range %q", s)
+	}
+	return uint16(lo), uint16(hi), nil
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// LoadRouteRules reads rules file. Each line consists of whitespace-separated
+// matcher kind, matcher value and outbound name. Blank lines and lines
+// starting with '#' are skipped. Special line "default <outbound>" sets
+// outbound for destinations not matched by any rule.
+func LoadRouteRules(filename string) ([]RouteRule, string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to open rules file %q: %w", filename, err)
+	}
+	defer f.Close()
+
+	defaultOutbound := OutboundTunnel
+	var rules []RouteRule
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		record := strings.Fields(scanner.Text())
+		switch {
+		case len(record) == 0 || strings.HasPrefix(record[0], "#"):
+			continue
+		case len(record) == 2 && strings.ToLower(record[0]) == "default":
+			defaultOutbound, err = parseOutbound(record[1])
+			if err != nil {
+				return nil, "", fmt.Errorf("error parsing rules file %q at line %d: %w", filename, line, err)
+			}
+		case len(record) == 3:
+			rule, err := ParseRouteRule(record[0], record[1], record[2])
+			if err != nil {
+				return nil, "", fmt.Errorf("error parsing rules file %q at line %d: %w", filename, line, err)
+			}
+			rules = append(rules, rule)
+		default:
+			return nil, "", fmt.Errorf("error parsing rules file %q at line %d: expected 3 fields, got %d", filename, line, len(record))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", fmt.Errorf("rules file parsing failed: %w", err)
+	}
+	return rules, defaultOutbound, nil
+}
+
+// RoutingDialer picks outbound dialer for each destination according to
+// first matching rule.
+type RoutingDialer struct {
+	rules           []RouteRule
+	defaultOutbound string
+	tunnel          ContextDialer
+	direct          ContextDialer
+}
+
+func NewRoutingDialer(rules []RouteRule, defaultOutbound string, tunnel, direct ContextDialer) *RoutingDialer {
+	return &RoutingDialer{
+		rules:           rules,
+		defaultOutbound: defaultOutbound,
+		tunnel:          tunnel,
+		direct:          direct,
+	}
+}
+
+// Route returns outbound name for destination address.
+func (d *RoutingDialer) Route(address string) (string, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", fmt.Errorf("failed to extract host and port from %s: %w", address, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", fmt.Errorf("bad port in address %s: %w", address, err)
+	}
+	host = normalizeHost(host)
+	for _, rule := range d.rules {
+		if rule.match(host, uint16(port)) {
+			return rule.Outbound, nil
+		}
+	}
+	return d.defaultOutbound, nil
+}
+
+func (d *RoutingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	outbound, err := d.Route(address)
+	if err != nil {
+		return nil, err
+	}
+	switch outbound {
+	case OutboundTunnel:
+		return d.tunnel.DialContext(ctx, network, address)
+	case OutboundDirect:
+		return d.direct.DialContext(ctx, network, address)
+	default:
+		return nil, fmt.Errorf("dial %s: %w", address, ErrRejected)
+	}
+}
+
+func (d *RoutingDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
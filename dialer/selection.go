@@ -21,6 +21,8 @@ const (
 	ServerSelectionFirst
 	ServerSelectionRandom
 	ServerSelectionFastest
+	ServerSelectionLowestLatency
+	ServerSelectionWeightedRandom
 )
 
 func (ss ServerSelection) String() string {
@@ -31,6 +33,10 @@ func (ss ServerSelection) String() string {
 		return "random"
 	case ServerSelectionFastest:
 		return "fastest"
+	case ServerSelectionLowestLatency:
+		return "lowest-latency"
+	case ServerSelectionWeightedRandom:
+		return "weighted-random"
 	default:
 		return fmt.Sprintf("ServerSelection(%d)", int(ss))
 	}
@@ -44,6 +50,10 @@ func ParseServerSelection(s string) (ServerSelection, error) {
 		return ServerSelectionRandom, nil
 	case "fastest":
 		return ServerSelectionFastest, nil
+	case "lowest-latency":
+		return ServerSelectionLowestLatency, nil
+	case "weighted-random":
+		return ServerSelectionWeightedRandom, nil
 	}
 	return 0, errors.New("unknown server selection strategy")
 }
@@ -64,7 +74,31 @@ func SelectRandom(_ context.Context, dialers []ContextDialer) (ContextDialer, er
 	return dialers[rand.IntN(len(dialers))], nil
 }
 
-func probeDialer(ctx context.Context, dialer ContextDialer, url string, dlLimit int64, tlsClientConfig *tls.Config) error {
+// ProbeResult holds measurements of single download through dialer.
+type ProbeResult struct {
+	// Upstream proxy connection setup timings
+	DialTrace
+	// TTFB is time from start of request to response headers.
+	TTFB time.Duration
+	// Duration is time from start of request to end of download.
+	Duration time.Duration
+	// Bytes is amount of downloaded response body.
+	Bytes int64
+}
+
+// Throughput returns download speed of response body in bytes per second.
+func (r ProbeResult) Throughput() float64 {
+	transfer := r.Duration - r.TTFB
+	if transfer <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / transfer.Seconds()
+}
+
+// ProbeDialer downloads url through dialer, reading at most dlLimit bytes
+// of response body if dlLimit is positive.
+func ProbeDialer(ctx context.Context, dialer ContextDialer, url string, dlLimit int64, tlsClientConfig *tls.Config) (ProbeResult, error) {
+	var res ProbeResult
 	httpClient := http.Client{
 		Transport: &http.Transport{
 			MaxIdleConns:          100,
@@ -76,27 +110,47 @@ func probeDialer(ctx context.Context, dialer ContextDialer, url string, dlLimit
 			ForceAttemptHTTP2:     true,
 		},
 	}
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	defer httpClient.CloseIdleConnections()
+	req, err := http.NewRequestWithContext(WithDialTrace(ctx, &res.DialTrace), "GET", url, nil)
 	if err != nil {
-		return err
+		return res, err
 	}
+	start := time.Now()
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return err
+		return res, err
 	}
 	defer resp.Body.Close()
+	res.TTFB = time.Since(start)
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status code %d for URL %q", resp.StatusCode, url)
+		return res, fmt.Errorf("bad status code %d for URL %q", resp.StatusCode, url)
 	}
 	var rd io.Reader = resp.Body
 	if dlLimit > 0 {
 		rd = io.LimitReader(rd, dlLimit)
 	}
-	_, err = io.Copy(io.Discard, rd)
-	return err
+	res.Bytes, err = io.Copy(io.Discard, rd)
+	res.Duration = time.Since(start)
+	return res, err
 }
 
-func NewFastestServerSelectionFunc(url string, dlLimit int64, tlsClientConfig *tls.Config) SelectionFunc {
+// NewFastestServerSelectionFunc returns selection function which picks
+// dialer completing download of url first. If samples is greater than one,
+// every dialer downloads url samples times and dialer with lowest average
+// download time is picked instead.
+func NewFastestServerSelectionFunc(url string, dlLimit int64, tlsClientConfig *tls.Config, samples int) SelectionFunc {
+	if samples > 1 {
+		return func(ctx context.Context, dialers []ContextDialer) (ContextDialer, error) {
+			results, err := measureDialers(ctx, dialers, samples, func(ctx context.Context, dialer ContextDialer) (time.Duration, error) {
+				res, err := ProbeDialer(ctx, dialer, url, dlLimit, tlsClientConfig)
+				return res.Duration, err
+			})
+			if err != nil {
+				return nil, err
+			}
+			return lowestLatency(results), nil
+		}
+	}
 	return func(ctx context.Context, dialers []ContextDialer) (ContextDialer, error) {
 		var resErr error
 		ctx, cl := context.WithCancel(ctx)
@@ -105,7 +159,7 @@ func NewFastestServerSelectionFunc(url string, dlLimit int64, tlsClientConfig *t
 		success := make(chan ContextDialer)
 		for _, dialer := range dialers {
 			go func(dialer ContextDialer) {
-				err := probeDialer(ctx, dialer, url, dlLimit, tlsClientConfig)
+				_, err := ProbeDialer(ctx, dialer, url, dlLimit, tlsClientConfig)
 				if err == nil {
 					select {
 					case success <- dialer:
@@ -132,3 +186,139 @@ func NewFastestServerSelectionFunc(url string, dlLimit int64, tlsClientConfig *t
 		return nil, resErr
 	}
 }
+
+// probeLatency establishes tunnel to target through dialer and returns time
+// spent on TLS handshake and CONNECT request to upstream proxy.
+func probeLatency(ctx context.Context, dialer ContextDialer, target string) (time.Duration, error) {
+	trace := new(DialTrace)
+	start := time.Now()
+	conn, err := dialer.DialContext(WithDialTrace(ctx, trace), "tcp", target)
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+	conn.Close()
+	if trace.Connect > 0 {
+		return trace.TLSHandshake + trace.Connect, nil
+	}
+	// Dialer isn't traced, so whole connection setup is measured.
+	return elapsed, nil
+}
+
+type latencyResult struct {
+	dialer  ContextDialer
+	latency time.Duration
+}
+
+// measureDialers probes all dialers concurrently, samples times each, and
+// returns average latency of successful probes for every dialer which
+// succeeded at least once.
+func measureDialers(ctx context.Context, dialers []ContextDialer, samples int,
+	probe func(context.Context, ContextDialer) (time.Duration, error)) ([]latencyResult, error) {
+	if len(dialers) == 0 {
+		return nil, errors.New("empty dialers list")
+	}
+	if samples < 1 {
+		samples = 1
+	}
+	type measurement struct {
+		latencyResult
+		err error
+	}
+	measurements := make(chan measurement, len(dialers))
+	for _, dialer := range dialers {
+		go func() {
+			var (
+				total time.Duration
+				n     int
+				err   error
+			)
+			for i := 0; i < samples && ctx.Err() == nil; i++ {
+				latency, probeErr := probe(ctx, dialer)
+				if probeErr != nil {
+					err = probeErr
+					continue
+				}
+				total += latency
+				n++
+			}
+			if n == 0 {
+				if err == nil {
+					err = ctx.Err()
+				}
+				measurements <- measurement{err: err}
+				return
+			}
+			measurements <- measurement{latencyResult: latencyResult{dialer, total / time.Duration(n)}}
+		}()
+	}
+	var (
+		resErr  error
+		results []latencyResult
+	)
+	for range dialers {
+		m := <-measurements
+		if m.err != nil {
+			resErr = multierror.Append(resErr, m.err)
+			continue
+		}
+		results = append(results, m.latencyResult)
+	}
+	if len(results) == 0 {
+		return nil, resErr
+	}
+	return results, nil
+}
+
+func lowestLatency(results []latencyResult) ContextDialer {
+	best := results[0]
+	for _, r := range results[1:] {
+		if r.latency < best.latency {
+			best = r
+		}
+	}
+	return best.dialer
+}
+
+// NewLowestLatencyServerSelectionFunc returns selection function which
+// picks dialer with lowest average TLS handshake and CONNECT latency over
+// samples tunnels established to target.
+func NewLowestLatencyServerSelectionFunc(target string, samples int) SelectionFunc {
+	return func(ctx context.Context, dialers []ContextDialer) (ContextDialer, error) {
+		results, err := measureDialers(ctx, dialers, samples, func(ctx context.Context, dialer ContextDialer) (time.Duration, error) {
+			return probeLatency(ctx, dialer, target)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return lowestLatency(results), nil
+	}
+}
+
+// NewWeightedRandomServerSelectionFunc returns selection function which
+// picks random dialer with probability inversely proportional to its
+// average latency measured like in lowest latency selection.
+func NewWeightedRandomServerSelectionFunc(target string, samples int) SelectionFunc {
+	return func(ctx context.Context, dialers []ContextDialer) (ContextDialer, error) {
+		results, err := measureDialers(ctx, dialers, samples, func(ctx context.Context, dialer ContextDialer) (time.Duration, error) {
+			return probeLatency(ctx, dialer, target)
+		})
+		if err != nil {
+			return nil, err
+		}
+		weights := make([]float64, len(results))
+		var total float64
+		for i, r := range results {
+			weights[i] = 1 / max(r.latency.Seconds(), 1e-6)
+			total += weights[i]
+		}
+		x := rand.Float64() * total
+		for i, w := range weights {
+			if x < w {
+				return results[i].dialer, nil
+			}
+			x -= w
+		}
+		return results[len(results)-1].dialer, nil
+	}
+}
@@ -0,0 +1,54 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+)
+
+// ErrNoDialer is returned by SwitchDialer until dialer is set.
+var ErrNoDialer = errors.New("no upstream endpoint selected")
+
+type dialerBox struct {
+	dialer ContextDialer
+}
+
+// SwitchDialer forwards dials to dialer which can be replaced at runtime.
+// Replacing dialer affects only new connections, connections established
+// earlier remain open until closed by their users. Initial dialer may be
+// nil, in which case dials fail until dialer is set.
+type SwitchDialer struct {
+	current atomic.Pointer[dialerBox]
+}
+
+func NewSwitchDialer(initial ContextDialer) *SwitchDialer {
+	d := &SwitchDialer{}
+	d.Set(initial)
+	return d
+}
+
+// Set replaces current dialer and returns previous one.
+func (d *SwitchDialer) Set(next ContextDialer) ContextDialer {
+	prev := d.current.Swap(&dialerBox{next})
+	if prev == nil {
+		return nil
+	}
+	return prev.dialer
+}
+
+func (d *SwitchDialer) Current() ContextDialer {
+	return d.current.Load().dialer
+}
+
+func (d *SwitchDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	current := d.Current()
+	if current == nil {
+		return nil, ErrNoDialer
+	}
+	return current.DialContext(ctx, network, address)
+}
+
+func (d *SwitchDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
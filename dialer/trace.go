@@ -0,0 +1,27 @@
+package dialer
+
+import (
+	"context"
+	"time"
+)
+
+// DialTrace receives durations of upstream proxy connection setup stages.
+// Stages which were not performed are left zero.
+type DialTrace struct {
+	TCPConnect   time.Duration
+	TLSHandshake time.Duration
+	Connect      time.Duration
+}
+
+type dialTraceKey struct{}
+
+// WithDialTrace returns context which makes ProxyDialer record connection
+// setup timings into trace.
+func WithDialTrace(ctx context.Context, trace *DialTrace) context.Context {
+	return context.WithValue(ctx, dialTraceKey{}, trace)
+}
+
+func dialTraceFromContext(ctx context.Context) *DialTrace {
+	trace, _ := ctx.Value(dialTraceKey{}).(*DialTrace)
+	return trace
+}
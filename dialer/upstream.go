@@ -15,6 +15,7 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"time"
 )
 
 const (
@@ -34,6 +35,32 @@ type ContextDialer interface {
 	DialContext(ctx context.Context, network, address string) (net.Conn, error)
 }
 
+// UpstreamError is returned when upstream proxy answers CONNECT request
+// with status other than 200.
+type UpstreamError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("bad response from upstream proxy server: %s", e.Status)
+}
+
+// destinationError reports whether upstream proxy itself is working, but
+// failed to connect to destination. Such errors say nothing about endpoint
+// health. Other non-200 responses are failures of endpoint.
+func destinationError(err error) bool {
+	var upErr *UpstreamError
+	if !errors.As(err, &upErr) {
+		return false
+	}
+	switch upErr.StatusCode {
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
 type ProxyDialer struct {
 	address       stringCb
 	tlsServerName stringCb
@@ -101,39 +128,56 @@ func (d *ProxyDialer) DialContext(ctx context.Context, network, address string)
 	if err != nil {
 		return nil, err
 	}
+	trace := dialTraceFromContext(ctx)
+	stageStart := time.Now()
 	conn, err := d.next.DialContext(ctx, "tcp", uAddress)
 	if err != nil {
 		return nil, err
 	}
+	if trace != nil {
+		trace.TCPConnect = time.Since(stageStart)
+	}
+	// CONNECT exchange doesn't take context, so connection is closed when
+	// context is done to interrupt it.
+	rawConn := conn
+	stopWatch := context.AfterFunc(ctx, func() { rawConn.Close() })
+	fail := func(err error) (net.Conn, error) {
+		if !stopWatch() {
+			// Connection is already closed by context, which is the
+			// cause of err.
+			return nil, ctx.Err()
+		}
+		rawConn.Close()
+		return nil, err
+	}
 
 	uTLSServerName, err := d.tlsServerName()
 	if err != nil {
-		return nil, err
+		return fail(err)
 	}
 	fakeSNI, err := d.fakeSNI()
 	if err != nil {
-		return nil, err
+		return fail(err)
 	}
 	if uTLSServerName != "" {
 		// Custom cert verification logic:
 		// DO NOT send SNI extension of TLS ClientHello
 		// DO peer certificate verification against specified servername
-		conn = tls.Client(conn, &tls.Config{
+		tlsConn := tls.Client(conn, &tls.Config{
 			ServerName:         fakeSNI,
 			InsecureSkipVerify: true,
 			VerifyConnection: func(cs tls.ConnectionState) error {
-				opts := x509.VerifyOptions{
-					DNSName:       uTLSServerName,
-					Intermediates: x509.NewCertPool(),
-					Roots:         d.caPool,
-				}
-				for _, cert := range cs.PeerCertificates[1:] {
-					opts.Intermediates.AddCert(cert)
-				}
-				_, err := cs.PeerCertificates[0].Verify(opts)
-				return err
+				return verifyPeerCertificates(cs.PeerCertificates, uTLSServerName, d.caPool)
 			},
 		})
+		stageStart = time.Now()
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return fail(err)
+		}
+		if trace != nil {
+			trace.TLSHandshake = time.Since(stageStart)
+		}
+		conn = tlsConn
 	}
 
 	req := &http.Request{
@@ -151,28 +195,38 @@ func (d *ProxyDialer) DialContext(ctx context.Context, network, address string)
 	if d.auth != nil {
 		auth, err := d.auth()
 		if err != nil {
-			return nil, err
+			return fail(err)
 		}
 		req.Header.Set(PROXY_AUTHORIZATION_HEADER, auth)
 	}
 
 	rawreq, err := httputil.DumpRequest(req, false)
 	if err != nil {
-		return nil, err
+		return fail(err)
 	}
 
+	stageStart = time.Now()
 	_, err = conn.Write(rawreq)
 	if err != nil {
-		return nil, err
+		return fail(err)
 	}
 
 	proxyResp, err := readResponse(conn, req)
 	if err != nil {
-		return nil, err
+		return fail(err)
 	}
 
 	if proxyResp.StatusCode != http.StatusOK {
-		return nil, errors.New(fmt.Sprintf("bad response from upstream proxy server: %s", proxyResp.Status))
+		return fail(&UpstreamError{
+			StatusCode: proxyResp.StatusCode,
+			Status:     proxyResp.Status,
+		})
+	}
+	if !stopWatch() {
+		return nil, ctx.Err()
+	}
+	if trace != nil {
+		trace.Connect = time.Since(stageStart)
 	}
 
 	return conn, nil
@@ -186,6 +240,24 @@ func (d *ProxyDialer) Address() (string, error) {
 	return d.address()
 }
 
+// verifyPeerCertificates verifies certificate chain presented by server
+// against serverName. Nil roots means system CA pool.
+func verifyPeerCertificates(certs []*x509.Certificate, serverName string, roots *x509.CertPool) error {
+	if len(certs) == 0 {
+		return errors.New("no peer certificates presented")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+		Roots:         roots,
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
 func readResponse(r io.Reader, req *http.Request) (*http.Response, error) {
 	endOfResponse := []byte("\r\n\r\n")
 	buf := &bytes.Buffer{}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	se "github.com/Snawoot/opera-proxy/seclient"
+)
+
+// countryList checks countries requested by clients against list of
+// countries offered by API, so unknown codes don't cause discovery. List is
+// fetched again when it is older than ttl.
+type countryList struct {
+	ttl       time.Duration
+	fetch     func(ctx context.Context) ([]se.SEGeoEntry, error)
+	mux       sync.Mutex
+	codes     map[string]bool
+	updatedAt time.Time
+}
+
+func newCountryList(ttl time.Duration, fetch func(ctx context.Context) ([]se.SEGeoEntry, error)) *countryList {
+	return &countryList{
+		ttl:   ttl,
+		fetch: fetch,
+	}
+}
+
+// Known reports whether country is offered by API. Stale list is used if
+// it can't be updated.
+func (l *countryList) Known(ctx context.Context, country string) (bool, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.codes == nil || time.Since(l.updatedAt) >= l.ttl {
+		geos, err := l.fetch(ctx)
+		switch {
+		case err == nil:
+			l.codes = make(map[string]bool, len(geos))
+			for _, geo := range geos {
+				l.codes[strings.ToUpper(geo.CountryCode)] = true
+			}
+			l.updatedAt = time.Now()
+		case l.codes == nil:
+			return false, err
+		}
+	}
+	return l.codes[strings.ToUpper(country)], nil
+}
@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	clog "github.com/Snawoot/opera-proxy/log"
+)
+
+const (
+	JSON_CONTENT_TYPE   = "application/json"
+	ADMIN_MAX_BODY_SIZE = 4096
+	ADMIN_STATUS_PATH   = "/api/status"
+	ADMIN_REFRESH_PATH  = "/api/refresh"
+	ADMIN_DISCOVER_PATH = "/api/rediscover"
+	ADMIN_COUNTRY_PATH  = "/api/country"
+)
+
+// ErrAdminConflict is returned by AdminController when requested operation
+// is not applicable in current configuration.
+var ErrAdminConflict = errors.New("operation is not applicable in current configuration")
+
+// ErrAdminBadRequest is returned by AdminController when arguments of
+// requested operation are invalid.
+var ErrAdminBadRequest = errors.New("invalid request")
+
+// AdminStatus describes state of running proxy instance.
+type AdminStatus struct {
+	Country                string    `json:"country"`
+	Endpoint               string    `json:"endpoint"`
+	EndpointFixed          bool      `json:"endpoint_fixed"`
+	CredentialsRefreshedAt time.Time `json:"credentials_refreshed_at"`
+	CredentialsAge         float64   `json:"credentials_age_seconds"`
+	StartedAt              time.Time `json:"started_at"`
+	Uptime                 float64   `json:"uptime_seconds"`
+}
+
+// AdminController performs runtime control operations requested via admin
+// API.
+type AdminController interface {
+	Status() AdminStatus
+	RefreshCredentials(ctx context.Context) error
+	Rediscover(ctx context.Context) error
+	SetCountry(ctx context.Context, country string) error
+}
+
+// AdminHandler exposes AdminController as JSON HTTP API:
+//
+//	GET  /api/status     - current country, endpoint, credentials age and uptime
+//	POST /api/refresh    - refresh login and proxy credentials immediately
+//	POST /api/rediscover - discover endpoints and select server again
+//	POST /api/country    - switch country, body is {"country": "<code>"}
+type AdminHandler struct {
+	ctl     AdminController
+	timeout time.Duration
+	logger  *clog.CondLogger
+	mux     *http.ServeMux
+}
+
+// NewAdminHandler returns admin API handler. Each control operation is
+// limited by timeout.
+func NewAdminHandler(ctl AdminController, timeout time.Duration, logger *clog.CondLogger) *AdminHandler {
+	h := &AdminHandler{
+		ctl:     ctl,
+		timeout: timeout,
+		logger:  logger,
+		mux:     http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET "+ADMIN_STATUS_PATH, h.handleStatus)
+	h.mux.HandleFunc("POST "+ADMIN_REFRESH_PATH, h.handleRefresh)
+	h.mux.HandleFunc("POST "+ADMIN_DISCOVER_PATH, h.handleRediscover)
+	h.mux.HandleFunc("POST "+ADMIN_COUNTRY_PATH, h.handleCountry)
+	return h
+}
+
+func (h *AdminHandler) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	h.mux.ServeHTTP(wr, req)
+}
+
+func (h *AdminHandler) handleStatus(wr http.ResponseWriter, req *http.Request) {
+	writeJSON(wr, http.StatusOK, h.ctl.Status())
+}
+
+func (h *AdminHandler) handleRefresh(wr http.ResponseWriter, req *http.Request) {
+	h.logger.Info("Credentials refresh requested by %s", req.RemoteAddr)
+	h.control(wr, req, h.ctl.RefreshCredentials)
+}
+
+func (h *AdminHandler) handleRediscover(wr http.ResponseWriter, req *http.Request) {
+	h.logger.Info("Rediscovery requested by %s", req.RemoteAddr)
+	h.control(wr, req, h.ctl.Rediscover)
+}
+
+func (h *AdminHandler) handleCountry(wr http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Country string `json:"country"`
+	}
+	dec := json.NewDecoder(io.LimitReader(req.Body, ADMIN_MAX_BODY_SIZE))
+	if err := dec.Decode(&body); err != nil {
+		writeJSONError(wr, http.StatusBadRequest, err)
+		return
+	}
+	country := strings.ToUpper(strings.TrimSpace(body.Country))
+	if !validCountry(country) {
+		writeJSONError(wr, http.StatusBadRequest, errors.New("country must be two-letter code"))
+		return
+	}
+	h.logger.Info("Country switch to %q requested by %s", country, req.RemoteAddr)
+	h.control(wr, req, func(ctx context.Context) error {
+		return h.ctl.SetCountry(ctx, country)
+	})
+}
+
+func (h *AdminHandler) control(wr http.ResponseWriter, req *http.Request, op func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(req.Context(), h.timeout)
+	defer cancel()
+	if err := op(ctx); err != nil {
+		h.logger.Error("Admin operation %s failed: %v", req.URL.Path, err)
+		code := http.StatusBadGateway
+		switch {
+		case errors.Is(err, ErrAdminConflict):
+			code = http.StatusConflict
+		case errors.Is(err, ErrAdminBadRequest):
+			code = http.StatusBadRequest
+		}
+		writeJSONError(wr, code, err)
+		return
+	}
+	writeJSON(wr, http.StatusOK, h.ctl.Status())
+}
+
+func writeJSON(wr http.ResponseWriter, code int, v any) {
+	wr.Header().Set("Content-Type", JSON_CONTENT_TYPE)
+	wr.Header().Set("Cache-Control", "no-cache")
+	wr.WriteHeader(code)
+	enc := json.NewEncoder(wr)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeJSONError(wr http.ResponseWriter, code int, err error) {
+	writeJSON(wr, code, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
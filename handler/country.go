@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"strings"
+)
+
+const (
+	COUNTRY_HEADER          = "X-Opera-Proxy-Country"
+	COUNTRY_USERNAME_PREFIX = "country-"
+)
+
+// SplitCountryUsername extracts country requested in proxy username.
+// Username may be either "country-XX" or "<user>-country-XX". It returns
+// username without country part and country code in upper case or empty
+// string if username doesn't request country.
+func SplitCountryUsername(username string) (string, string) {
+	idx := strings.LastIndex(username, COUNTRY_USERNAME_PREFIX)
+	if idx < 0 {
+		return username, ""
+	}
+	country := username[idx+len(COUNTRY_USERNAME_PREFIX):]
+	if !validCountry(country) {
+		return username, ""
+	}
+	switch {
+	case idx == 0:
+		return "", strings.ToUpper(country)
+	case username[idx-1] == '-':
+		return username[:idx-1], strings.ToUpper(country)
+	}
+	return username, ""
+}
+
+// UsernameWithoutCountry strips country option from proxy username.
+func UsernameWithoutCountry(username string) string {
+	base, _ := SplitCountryUsername(username)
+	return base
+}
+
+func validCountry(country string) bool {
+	if len(country) != 2 {
+		return false
+	}
+	for _, c := range []byte(country) {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	clog "github.com/Snawoot/opera-proxy/log"
+	"github.com/Snawoot/opera-proxy/resolver"
+)
+
+const (
+	DNS_HEADER_SIZE      = 12
+	DNS_DEFAULT_UDP_SIZE = 512
+	DNS_MAX_UDP_SIZE     = 4096
+	DNS_TYPE_OPT         = 41
+	DNS_FLAG_TC          = 0x02
+)
+
+// DNSServer accepts DNS queries over UDP, TCP and DoH and forwards them
+// to exchanger.
+type DNSServer struct {
+	exchanger resolver.Exchanger
+	timeout   time.Duration
+	logger    *clog.CondLogger
+}
+
+func NewDNSServer(exchanger resolver.Exchanger, timeout time.Duration, logger *clog.CondLogger) *DNSServer {
+	return &DNSServer{
+		exchanger: exchanger,
+		timeout:   timeout,
+		logger:    logger,
+	}
+}
+
+func (s *DNSServer) exchange(query []byte) ([]byte, error) {
+	if len(query) < DNS_HEADER_SIZE {
+		return nil, errors.New("DNS message is too short")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	return s.exchanger.Exchange(ctx, query)
+}
+
+func (s *DNSServer) ServeUDP(pc net.PacketConn) error {
+	defer pc.Close()
+	buf := make([]byte, resolver.MAX_DNS_MESSAGE_SIZE)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go func() {
+			resp, err := s.exchange(query)
+			if err != nil {
+				s.logger.Error("DNS query from %s failed: %v", addr, err)
+				return
+			}
+			if limit := udpSizeLimit(query); len(resp) > limit {
+				resp = truncatedResponse(query, resp)
+			}
+			if _, err := pc.WriteTo(resp, addr); err != nil {
+				s.logger.Debug("Unable to send DNS response to %s: %v", addr, err)
+			}
+		}()
+	}
+}
+
+func (s *DNSServer) ServeTCP(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveTCPConn(conn)
+	}
+}
+
+func (s *DNSServer) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	var lenBuf [2]byte
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.timeout))
+		if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		resp, err := s.exchange(query)
+		if err != nil {
+			s.logger.Error("DNS query from %s failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+		out := make([]byte, 2+len(resp))
+		binary.BigEndian.PutUint16(out, uint16(len(resp)))
+		copy(out[2:], resp)
+		conn.SetWriteDeadline(time.Now().Add(s.timeout))
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+// ServeHTTP implements DoH (RFC 8484) endpoint.
+func (s *DNSServer) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	var (
+		query []byte
+		err   error
+	)
+	switch req.Method {
+	case http.MethodGet:
+		query, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != resolver.DNS_MESSAGE_CONTENT_TYPE {
+			http.Error(wr, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+		query, err = io.ReadAll(io.LimitReader(req.Body, resolver.MAX_DNS_MESSAGE_SIZE))
+	default:
+		http.Error(wr, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(query) < DNS_HEADER_SIZE {
+		http.Error(wr, BAD_REQ_MSG, http.StatusBadRequest)
+		return
+	}
+	resp, err := s.exchange(query)
+	if err != nil {
+		s.logger.Error("DoH query from %s failed: %v", req.RemoteAddr, err)
+		http.Error(wr, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	wr.Header().Set("Content-Type", resolver.DNS_MESSAGE_CONTENT_TYPE)
+	wr.Write(resp)
+}
+
+// udpSizeLimit returns maximum response size acceptable by client over UDP
+// according to EDNS0 OPT record in query.
+func udpSizeLimit(query []byte) int {
+	if len(query) < DNS_HEADER_SIZE {
+		return DNS_DEFAULT_UDP_SIZE
+	}
+	qdCount := int(binary.BigEndian.Uint16(query[4:6]))
+	rrCount := int(binary.BigEndian.Uint16(query[6:8])) +
+		int(binary.BigEndian.Uint16(query[8:10])) +
+		int(binary.BigEndian.Uint16(query[10:12]))
+	off := DNS_HEADER_SIZE
+	for i := 0; i < qdCount; i++ {
+		off = skipName(query, off)
+		if off < 0 || off+4 > len(query) {
+			return DNS_DEFAULT_UDP_SIZE
+		}
+		off += 4
+	}
+	for i := 0; i < rrCount; i++ {
+		off = skipName(query, off)
+		if off < 0 || off+10 > len(query) {
+			return DNS_DEFAULT_UDP_SIZE
+		}
+		rrType := binary.BigEndian.Uint16(query[off : off+2])
+		if rrType == DNS_TYPE_OPT {
+			size := int(binary.BigEndian.Uint16(query[off+2 : off+4]))
+			return min(max(size, DNS_DEFAULT_UDP_SIZE), DNS_MAX_UDP_SIZE)
+		}
+		off += 10 + int(binary.BigEndian.Uint16(query[off+8:off+10]))
+	}
+	return DNS_DEFAULT_UDP_SIZE
+}
+
+// skipName returns offset right after domain name starting at off or -1
+// if name is malformed.
+func skipName(msg []byte, off int) int {
+	for off >= 0 && off < len(msg) {
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1
+		case l&0xC0 == 0xC0:
+			return off + 2
+		default:
+			off += 1 + l
+		}
+	}
+	return -1
+}
+
+// truncatedResponse builds empty response with TC flag set, signaling
+// client to retry over TCP.
+func truncatedResponse(query, resp []byte) []byte {
+	qEnd := DNS_HEADER_SIZE
+	for i := 0; i < int(binary.BigEndian.Uint16(query[4:6])); i++ {
+		qEnd = skipName(query, qEnd)
+		if qEnd < 0 {
+			qEnd = DNS_HEADER_SIZE
+			break
+		}
+		qEnd += 4
+	}
+	qEnd = min(qEnd, len(query))
+	res := make([]byte, qEnd)
+	copy(res, resp[:DNS_HEADER_SIZE])
+	copy(res[DNS_HEADER_SIZE:], query[DNS_HEADER_SIZE:qEnd])
+	res[2] |= DNS_FLAG_TC
+	if qEnd == DNS_HEADER_SIZE {
+		binary.BigEndian.PutUint16(res[4:6], 0)
+	}
+	binary.BigEndian.PutUint16(res[6:8], 0)
+	binary.BigEndian.PutUint16(res[8:10], 0)
+	binary.BigEndian.PutUint16(res[10:12], 0)
+	return res
+}
@@ -12,8 +12,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/Snawoot/opera-proxy/auth"
 	"github.com/Snawoot/opera-proxy/dialer"
 	clog "github.com/Snawoot/opera-proxy/log"
+	"github.com/Snawoot/opera-proxy/metrics"
 )
 
 const (
@@ -25,20 +27,71 @@ type ProxyHandler struct {
 	logger        *clog.CondLogger
 	dialer        dialer.ContextDialer
 	httptransport http.RoundTripper
+	auth          auth.Auth
+	local         http.Handler
+
+	countryTransportsMux sync.Mutex
+	countryTransports    map[string]http.RoundTripper
+}
+
+// NewProxyHandler returns HTTP proxy handler. Incoming requests are
+// authenticated with auth unless it is nil. Requests addressed to proxy
+// itself rather than to remote server are passed to local handler if it
+// is not nil. Clients may request exit country with proxy username (see
+// SplitCountryUsername) or with COUNTRY_HEADER request header.
+func NewProxyHandler(dialer dialer.ContextDialer, auth auth.Auth, local http.Handler, logger *clog.CondLogger) *ProxyHandler {
+	return &ProxyHandler{
+		logger:            logger,
+		dialer:            dialer,
+		httptransport:     newProxyTransport(dialer.DialContext),
+		auth:              auth,
+		local:             local,
+		countryTransports: make(map[string]http.RoundTripper),
+	}
 }
 
-func NewProxyHandler(dialer dialer.ContextDialer, logger *clog.CondLogger) *ProxyHandler {
-	httptransport := &http.Transport{
+func newProxyTransport(dial func(ctx context.Context, network, address string) (net.Conn, error)) *http.Transport {
+	return &http.Transport{
 		MaxIdleConns:          100,
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
-		DialContext:           dialer.DialContext,
+		DialContext:           dial,
 	}
-	return &ProxyHandler{
-		logger:        logger,
-		dialer:        dialer,
-		httptransport: httptransport,
+}
+
+// transport returns round tripper for requests exiting in country. Pooled
+// connections must not be shared between countries, so each country gets
+// its own transport.
+func (s *ProxyHandler) transport(country string) http.RoundTripper {
+	if country == "" {
+		return s.httptransport
+	}
+	s.countryTransportsMux.Lock()
+	defer s.countryTransportsMux.Unlock()
+	t, ok := s.countryTransports[country]
+	if !ok {
+		t = newProxyTransport(func(ctx context.Context, network, address string) (net.Conn, error) {
+			return s.dialer.DialContext(dialer.WithCountry(ctx, country), network, address)
+		})
+		s.countryTransports[country] = t
+	}
+	return t
+}
+
+// CloseIdleConnections closes pooled connections of forwarded requests, so
+// next requests go through currently selected endpoints.
+func (s *ProxyHandler) CloseIdleConnections() {
+	closeIdle := func(t http.RoundTripper) {
+		if closer, ok := t.(interface{ CloseIdleConnections() }); ok {
+			closer.CloseIdleConnections()
+		}
+	}
+	closeIdle(s.httptransport)
+	s.countryTransportsMux.Lock()
+	defer s.countryTransportsMux.Unlock()
+	for _, t := range s.countryTransports {
+		closeIdle(t)
 	}
 }
 
@@ -46,6 +99,11 @@ func (s *ProxyHandler) HandleTunnel(wr http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
 	conn, err := s.dialer.DialContext(ctx, "tcp", req.RequestURI)
 	if err != nil {
+		if errors.Is(err, dialer.ErrRejected) {
+			s.logger.Info("CONNECT to %s rejected by routing rules", req.RequestURI)
+			http.Error(wr, "Forbidden", http.StatusForbidden)
+			return
+		}
 		s.logger.Error("Can't satisfy CONNECT request: %v", err)
 		http.Error(wr, "Can't satisfy CONNECT request", http.StatusBadGateway)
 		return
@@ -83,8 +141,14 @@ func (s *ProxyHandler) HandleRequest(wr http.ResponseWriter, req *http.Request)
 		req.URL.Scheme = "http" // We can't access :scheme pseudo-header, so assume http
 		req.URL.Host = req.Host
 	}
-	resp, err := s.httptransport.RoundTrip(req)
+	country, _ := dialer.CountryFromContext(req.Context())
+	resp, err := s.transport(country).RoundTrip(req)
 	if err != nil {
+		if errors.Is(err, dialer.ErrRejected) {
+			s.logger.Info("Request to %s rejected by routing rules", req.URL.Host)
+			http.Error(wr, "Forbidden", http.StatusForbidden)
+			return
+		}
 		s.logger.Error("HTTP fetch error: %v", err)
 		http.Error(wr, "Server Error", http.StatusInternalServerError)
 		return
@@ -102,11 +166,45 @@ func (s *ProxyHandler) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 	s.logger.Info("Request: %v %v %v %v", req.RemoteAddr, req.Proto, req.Method, req.URL)
 
 	isConnect := strings.ToUpper(req.Method) == "CONNECT"
+	if s.local != nil && !isConnect && req.ProtoMajor < 2 && req.URL.Host == "" {
+		s.local.ServeHTTP(wr, req)
+		return
+	}
 	if (req.URL.Host == "" || req.URL.Scheme == "" && !isConnect) && req.ProtoMajor < 2 ||
 		req.Host == "" && req.ProtoMajor == 2 {
 		http.Error(wr, BAD_REQ_MSG, http.StatusBadRequest)
 		return
 	}
+	var username string
+	if s.auth != nil {
+		var ok bool
+		username, ok = s.auth.Validate(wr, req)
+		if !ok {
+			if req.Header.Get(auth.PROXY_AUTHORIZATION_HEADER) != "" {
+				s.logger.Warning("Authentication failed for %v", req.RemoteAddr)
+			}
+			return
+		}
+		s.logger.Debug("Client %v authenticated as %q", req.RemoteAddr, username)
+	} else {
+		username = auth.RequestUsername(req)
+	}
+	// Credentials may carry country even without authentication, so they
+	// must not reach origin server in any case.
+	req.Header.Del(auth.PROXY_AUTHORIZATION_HEADER)
+	_, country := SplitCountryUsername(username)
+	if h := strings.TrimSpace(req.Header.Get(COUNTRY_HEADER)); h != "" {
+		if !validCountry(h) {
+			http.Error(wr, BAD_REQ_MSG, http.StatusBadRequest)
+			return
+		}
+		country = strings.ToUpper(h)
+	}
+	req.Header.Del(COUNTRY_HEADER)
+	if country != "" {
+		s.logger.Debug("Client %v requested country %s", req.RemoteAddr, country)
+		req = req.WithContext(dialer.WithCountry(req.Context(), country))
+	}
 	delHopHeaders(req.Header)
 	if isConnect {
 		s.HandleTunnel(wr, req)
@@ -116,15 +214,18 @@ func (s *ProxyHandler) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 }
 
 func proxy(ctx context.Context, left, right net.Conn) {
+	metrics.ActiveTunnels.Inc()
+	defer metrics.ActiveTunnels.Dec()
 	wg := sync.WaitGroup{}
-	cpy := func(dst, src net.Conn) {
+	cpy := func(dst, src net.Conn, direction string) {
 		defer wg.Done()
-		io.Copy(dst, src)
+		n, _ := io.Copy(dst, src)
+		metrics.BytesCopied.WithLabelValues(direction).Add(float64(n))
 		dst.Close()
 	}
 	wg.Add(2)
-	go cpy(left, right)
-	go cpy(right, left)
+	go cpy(left, right, metrics.DirectionDownstream)
+	go cpy(right, left, metrics.DirectionUpstream)
 	groupdone := make(chan struct{})
 	go func() {
 		wg.Wait()
@@ -142,10 +243,13 @@ func proxy(ctx context.Context, left, right net.Conn) {
 }
 
 func proxyh2(ctx context.Context, leftreader io.ReadCloser, leftwriter io.Writer, right net.Conn) {
+	metrics.ActiveTunnels.Inc()
+	defer metrics.ActiveTunnels.Dec()
 	wg := sync.WaitGroup{}
 	ltr := func(dst net.Conn, src io.Reader) {
 		defer wg.Done()
-		io.Copy(dst, src)
+		n, _ := io.Copy(dst, src)
+		metrics.BytesCopied.WithLabelValues(metrics.DirectionUpstream).Add(float64(n))
 		dst.Close()
 	}
 	rtl := func(dst io.Writer, src io.Reader) {
@@ -227,11 +331,14 @@ func flush(flusher interface{}) bool {
 
 func copyBody(wr io.Writer, body io.Reader) {
 	buf := make([]byte, COPY_BUF)
+	counter := metrics.BytesCopied.WithLabelValues(metrics.DirectionDownstream)
 	for {
 		bread, read_err := body.Read(buf)
 		var write_err error
 		if bread > 0 {
-			_, write_err = wr.Write(buf[:bread])
+			var bwritten int
+			bwritten, write_err = wr.Write(buf[:bread])
+			counter.Add(float64(bwritten))
 			flush(wr)
 		}
 		if read_err != nil || write_err != nil {
@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	clog "github.com/Snawoot/opera-proxy/log"
+)
+
+const (
+	SOCKS4_VERSION = 0x04
+	SOCKS5_VERSION = 0x05
+)
+
+// ProtocolMux splits connections accepted on a single listener between
+// HTTP and SOCKS servers by peeking at the first byte sent by client.
+type ProtocolMux struct {
+	listener  net.Listener
+	timeout   time.Duration
+	logger    *clog.CondLogger
+	httpSink  *connSink
+	socksSink *connSink
+	closeOnce sync.Once
+}
+
+func NewProtocolMux(l net.Listener, timeout time.Duration, logger *clog.CondLogger) *ProtocolMux {
+	return &ProtocolMux{
+		listener:  l,
+		timeout:   timeout,
+		logger:    logger,
+		httpSink:  newConnSink(l.Addr()),
+		socksSink: newConnSink(l.Addr()),
+	}
+}
+
+// HTTP returns listener which yields connections recognized as HTTP.
+func (m *ProtocolMux) HTTP() net.Listener {
+	return m.httpSink
+}
+
+// SOCKS returns listener which yields connections recognized as SOCKS4/5.
+func (m *ProtocolMux) SOCKS() net.Listener {
+	return m.socksSink
+}
+
+// Serve runs accept loop until underlying listener fails.
+func (m *ProtocolMux) Serve() error {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			m.shutdown(err)
+			return err
+		}
+		go m.dispatch(conn)
+	}
+}
+
+func (m *ProtocolMux) shutdown(err error) {
+	m.closeOnce.Do(func() {
+		m.httpSink.shutdown(err)
+		m.socksSink.shutdown(err)
+	})
+}
+
+func (m *ProtocolMux) dispatch(conn net.Conn) {
+	rd := bufio.NewReader(conn)
+	if m.timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(m.timeout))
+	}
+	first, err := rd.Peek(1)
+	if err != nil {
+		m.logger.Debug("Unable to detect protocol of connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	peeked := &peekedConn{
+		Conn: conn,
+		rd:   rd,
+	}
+	switch first[0] {
+	case SOCKS4_VERSION, SOCKS5_VERSION:
+		m.socksSink.push(peeked)
+	default:
+		m.httpSink.push(peeked)
+	}
+}
+
+type peekedConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+// Read drains peeked data first and then reads connection directly, so
+// errors which happened during peeking are not returned to consumer.
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if c.rd.Buffered() > 0 {
+		return c.rd.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// connSink is a net.Listener fed with connections from elsewhere.
+type connSink struct {
+	addr net.Addr
+	ch   chan net.Conn
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func newConnSink(addr net.Addr) *connSink {
+	return &connSink{
+		addr: addr,
+		ch:   make(chan net.Conn),
+		done: make(chan struct{}),
+		err:  net.ErrClosed,
+	}
+}
+
+func (s *connSink) push(conn net.Conn) {
+	select {
+	case s.ch <- conn:
+	case <-s.done:
+		conn.Close()
+	}
+}
+
+func (s *connSink) shutdown(err error) {
+	s.once.Do(func() {
+		if err != nil {
+			s.err = err
+		}
+		close(s.done)
+	})
+}
+
+func (s *connSink) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.ch:
+		return conn, nil
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+func (s *connSink) Close() error {
+	s.shutdown(nil)
+	return nil
+}
+
+func (s *connSink) Addr() net.Addr {
+	return s.addr
+}
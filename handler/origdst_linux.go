@@ -0,0 +1,83 @@
+//go:build linux
+
+package handler
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// SO_ORIGINAL_DST from linux/netfilter_ipv4.h. IP6T_SO_ORIGINAL_DST from
+// linux/netfilter_ipv6/ip6_tables.h has the same value.
+const SO_ORIGINAL_DST = 80
+
+// originalDst returns destination address of connection before it was
+// redirected by netfilter REDIRECT or DNAT target.
+func originalDst(conn net.Conn) (netip.AddrPort, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return netip.AddrPort{}, errors.New("connection doesn't expose file descriptor")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	preferV6 := true
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok && tcpAddr.IP.To4() != nil {
+		preferV6 = false
+	}
+
+	var (
+		res    netip.AddrPort
+		optErr error
+	)
+	err = rc.Control(func(fd uintptr) {
+		if preferV6 {
+			res, optErr = originalDst6(int(fd))
+			if optErr == nil {
+				return
+			}
+		}
+		res, optErr = originalDst4(int(fd))
+		if optErr != nil && !preferV6 {
+			res, optErr = originalDst6(int(fd))
+		}
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if optErr != nil {
+		return netip.AddrPort{}, fmt.Errorf("getsockopt(SO_ORIGINAL_DST) failed: %w", optErr)
+	}
+	return res, nil
+}
+
+func originalDst4(fd int) (netip.AddrPort, error) {
+	// struct sockaddr_in fits into storage of IPv6Mreq
+	mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.SOL_IP, SO_ORIGINAL_DST)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	raw := mreq.Multiaddr
+	port := binary.BigEndian.Uint16(raw[2:4])
+	addr := netip.AddrFrom4([4]byte(raw[4:8]))
+	return netip.AddrPortFrom(addr, port), nil
+}
+
+func originalDst6(fd int) (netip.AddrPort, error) {
+	// struct sockaddr_in6 fits into storage of IPv6MTUInfo
+	info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.SOL_IPV6, SO_ORIGINAL_DST)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	var portBytes [2]byte
+	binary.NativeEndian.PutUint16(portBytes[:], info.Addr.Port)
+	port := binary.BigEndian.Uint16(portBytes[:])
+	addr := netip.AddrFrom16(info.Addr.Addr).Unmap()
+	return netip.AddrPortFrom(addr, port), nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package handler
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+func originalDst(_ net.Conn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errors.New("transparent proxy mode is supported only on Linux")
+}
@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"text/template"
+
+	clog "github.com/Snawoot/opera-proxy/log"
+)
+
+const PAC_CONTENT_TYPE = "application/x-ns-proxy-autoconfig"
+
+var pacTemplate = template.Must(template.New("pac").Parse(`function FindProxyForURL(url, host) {
+	var proxy = {{.Proxy}};
+	var proxyDomains = {{.ProxyDomains}};
+	var directDomains = {{.DirectDomains}};
+	var matches = function (domains) {
+		for (var i = 0; i < domains.length; i++) {
+			if (host === domains[i] || dnsDomainIs(host, "." + domains[i])) {
+				return true;
+			}
+		}
+		return false;
+	};
+	host = host.toLowerCase();
+	if (isPlainHostName(host) || matches(directDomains)) {
+		return "DIRECT";
+	}
+	if (proxyDomains.length === 0 || matches(proxyDomains)) {
+		return proxy;
+	}
+	return "DIRECT";
+}
+`))
+
+// PACHandler serves proxy auto-configuration script pointing to this proxy.
+type PACHandler struct {
+	proxyAddress  string
+	proxyDomains  []string
+	directDomains []string
+	logger        *clog.CondLogger
+}
+
+// NewPACHandler returns PAC file handler. If proxyAddress is empty, the
+// address client used to reach this server is advertised. Empty list of
+// proxyDomains means all hosts except directDomains go through proxy.
+func NewPACHandler(proxyAddress string, proxyDomains, directDomains []string, logger *clog.CondLogger) *PACHandler {
+	return &PACHandler{
+		proxyAddress:  proxyAddress,
+		proxyDomains:  normalizeDomains(proxyDomains),
+		directDomains: normalizeDomains(directDomains),
+		logger:        logger,
+	}
+}
+
+func normalizeDomains(domains []string) []string {
+	res := make([]string, 0, len(domains))
+	for _, d := range domains {
+		d = strings.Trim(strings.ToLower(strings.TrimSpace(d)), ".")
+		if d != "" {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+func (h *PACHandler) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(wr, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	proxyType := "PROXY"
+	if req.TLS != nil {
+		proxyType = "HTTPS"
+	}
+	proxy, _ := json.Marshal(proxyType + " " + h.advertisedAddress(req))
+	proxyDomains, _ := json.Marshal(h.proxyDomains)
+	directDomains, _ := json.Marshal(h.directDomains)
+
+	var buf bytes.Buffer
+	err := pacTemplate.Execute(&buf, struct {
+		Proxy, ProxyDomains, DirectDomains string
+	}{string(proxy), string(proxyDomains), string(directDomains)})
+	if err != nil {
+		h.logger.Error("Unable to render PAC file: %v", err)
+		http.Error(wr, "Server Error", http.StatusInternalServerError)
+		return
+	}
+	wr.Header().Set("Content-Type", PAC_CONTENT_TYPE)
+	wr.Header().Set("Cache-Control", "no-cache")
+	wr.Write(buf.Bytes())
+}
+
+func (h *PACHandler) advertisedAddress(req *http.Request) string {
+	if h.proxyAddress != "" {
+		return h.proxyAddress
+	}
+	if req.Host != "" {
+		return req.Host
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr.String()
+	}
+	return ""
+}
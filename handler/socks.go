@@ -1,15 +1,35 @@
 package handler
 
 import (
+	"bufio"
 	"context"
 	"log"
 	"net"
 
+	"github.com/Snawoot/opera-proxy/auth"
 	"github.com/Snawoot/opera-proxy/dialer"
 	"github.com/things-go/go-socks5"
 )
 
-func NewSocksServer(dialer dialer.ContextDialer, logger *log.Logger) (*socks5.Server, error) {
+// SocksServer serves SOCKS5 and SOCKS4/4a clients on the same listener.
+type SocksServer struct {
+	socks5 *socks5.Server
+	dialer dialer.ContextDialer
+	creds  auth.CredStore
+	logger *log.Logger
+}
+
+// NewSocksServer returns SOCKS server. If creds is not nil, clients are
+// required to pass RFC 1929 username/password authentication.
+// SOCKS4 has no means to pass password, so SOCKS4 clients are rejected
+// when authentication is enabled. Clients may request exit country with
+// username (SOCKS5) or user ID (SOCKS4), see SplitCountryUsername.
+func NewSocksServer(dialer dialer.ContextDialer, creds auth.CredStore, logger *log.Logger) (*SocksServer, error) {
+	s := &SocksServer{
+		dialer: dialer,
+		creds:  creds,
+		logger: logger,
+	}
 	opts := []socks5.Option{
 		socks5.WithLogger(socks5.NewLogger(logger)),
 		socks5.WithRule(
@@ -17,10 +37,74 @@ func NewSocksServer(dialer dialer.ContextDialer, logger *log.Logger) (*socks5.Se
 				EnableConnect: true,
 			},
 		),
-		socks5.WithDial(dialer.DialContext),
+		socks5.WithDialAndRequest(s.dialSocks5),
 		socks5.WithResolver(DummySocksResolver{}),
 	}
-	return socks5.NewServer(opts...), nil
+	if creds != nil {
+		opts = append(opts, socks5.WithCredential(socksCredentials{
+			store:  creds,
+			logger: logger,
+		}))
+	} else {
+		// Accept any username/password from clients offering it, so
+		// username can still carry options.
+		opts = append(opts, socks5.WithAuthMethods([]socks5.Authenticator{
+			socks5.UserPassAuthenticator{Credentials: anySocksCredentials{}},
+			socks5.NoAuthAuthenticator{},
+		}))
+	}
+	s.socks5 = socks5.NewServer(opts...)
+	return s, nil
+}
+
+func (s *SocksServer) dialSocks5(ctx context.Context, network, address string, req *socks5.Request) (net.Conn, error) {
+	if req.AuthContext != nil {
+		if _, country := SplitCountryUsername(req.AuthContext.Payload["username"]); country != "" {
+			ctx = dialer.WithCountry(ctx, country)
+		}
+	}
+	return s.dialer.DialContext(ctx, network, address)
+}
+
+func (s *SocksServer) ListenAndServe(network, addr string) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+func (s *SocksServer) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := s.ServeConn(conn); err != nil {
+				s.logger.Printf("[E]: server: %v", err)
+			}
+		}()
+	}
+}
+
+// ServeConn detects SOCKS version of client and serves single connection.
+func (s *SocksServer) ServeConn(conn net.Conn) error {
+	rd := bufio.NewReader(conn)
+	ver, err := rd.Peek(1)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	peeked := &peekedConn{
+		Conn: conn,
+		rd:   rd,
+	}
+	if ver[0] == SOCKS4_VERSION {
+		return s.serveSocks4(peeked)
+	}
+	return s.socks5.ServeConn(peeked)
 }
 
 type DummySocksResolver struct{}
@@ -28,3 +112,22 @@ type DummySocksResolver struct{}
 func (_ DummySocksResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
 	return ctx, nil, nil
 }
+
+type socksCredentials struct {
+	store  auth.CredStore
+	logger *log.Logger
+}
+
+func (c socksCredentials) Valid(user, password, userAddr string) bool {
+	if c.store.Verify(user, password) {
+		return true
+	}
+	c.logger.Printf("[W]: authentication failed for user %q from %s", user, userAddr)
+	return false
+}
+
+type anySocksCredentials struct{}
+
+func (_ anySocksCredentials) Valid(_, _, _ string) bool {
+	return true
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/Snawoot/opera-proxy/dialer"
+)
+
+const (
+	SOCKS4_CMD_CONNECT     = 0x01
+	SOCKS4_REPLY_GRANTED   = 0x5a
+	SOCKS4_REPLY_REJECTED  = 0x5b
+	SOCKS4_MAX_FIELD_LEN   = 255
+	SOCKS4_FIXED_HEADER_SZ = 8
+)
+
+type socks4Request struct {
+	command byte
+	userID  string
+	address string
+}
+
+// readSocks4Request parses SOCKS4 request. SOCKS4a hostname is kept
+// unresolved in resulting address.
+func readSocks4Request(rd *bufio.Reader) (*socks4Request, error) {
+	var hdr [SOCKS4_FIXED_HEADER_SZ]byte
+	if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+		return nil, fmt.Errorf("unable to read SOCKS4 request: %w", err)
+	}
+	if hdr[0] != SOCKS4_VERSION {
+		return nil, fmt.Errorf("unexpected SOCKS version %d", hdr[0])
+	}
+	port := binary.BigEndian.Uint16(hdr[2:4])
+	ip := net.IPv4(hdr[4], hdr[5], hdr[6], hdr[7])
+
+	userID, err := readNulString(rd)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read SOCKS4 user ID: %w", err)
+	}
+
+	host := ip.String()
+	// SOCKS4a: address 0.0.0.x with nonzero x indicates hostname follows
+	if hdr[4] == 0 && hdr[5] == 0 && hdr[6] == 0 && hdr[7] != 0 {
+		host, err = readNulString(rd)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read SOCKS4a hostname: %w", err)
+		}
+		if host == "" {
+			return nil, errors.New("empty SOCKS4a hostname")
+		}
+	}
+
+	return &socks4Request{
+		command: hdr[1],
+		userID:  userID,
+		address: net.JoinHostPort(host, strconv.Itoa(int(port))),
+	}, nil
+}
+
+func readNulString(rd *bufio.Reader) (string, error) {
+	var buf []byte
+	for {
+		b, err := rd.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(buf), nil
+		}
+		if len(buf) >= SOCKS4_MAX_FIELD_LEN {
+			return "", errors.New("field is too long")
+		}
+		buf = append(buf, b)
+	}
+}
+
+func writeSocks4Reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func (s *SocksServer) serveSocks4(conn *peekedConn) error {
+	defer conn.Close()
+
+	req, err := readSocks4Request(conn.rd)
+	if err != nil {
+		return err
+	}
+	if s.creds != nil {
+		writeSocks4Reply(conn, SOCKS4_REPLY_REJECTED)
+		return fmt.Errorf("rejected SOCKS4 request from %s: authentication is required", conn.RemoteAddr())
+	}
+	if req.command != SOCKS4_CMD_CONNECT {
+		writeSocks4Reply(conn, SOCKS4_REPLY_REJECTED)
+		return fmt.Errorf("unsupported SOCKS4 command %d", req.command)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, country := SplitCountryUsername(req.userID); country != "" {
+		ctx = dialer.WithCountry(ctx, country)
+	}
+	target, err := s.dialer.DialContext(ctx, "tcp", req.address)
+	if err != nil {
+		writeSocks4Reply(conn, SOCKS4_REPLY_REJECTED)
+		return fmt.Errorf("connect to %v failed: %w", req.address, err)
+	}
+	if err := writeSocks4Reply(conn, SOCKS4_REPLY_GRANTED); err != nil {
+		target.Close()
+		return err
+	}
+
+	proxy(ctx, conn, target)
+	return nil
+}
@@ -0,0 +1,267 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+
+	"github.com/Snawoot/opera-proxy/dialer"
+	clog "github.com/Snawoot/opera-proxy/log"
+)
+
+const (
+	SNIFF_BUF_SIZE = 16 * 1024
+	SNIFF_TIMEOUT  = 2 * time.Second
+)
+
+// TransparentServer accepts connections redirected to it by netfilter and
+// forwards them to their original destinations through dialer. Destination
+// hostname is recovered from TLS SNI or HTTP Host header when possible, so
+// name resolution happens on the upstream side.
+type TransparentServer struct {
+	dialer   dialer.ContextDialer
+	logger   *clog.CondLogger
+	origDst  func(net.Conn) (netip.AddrPort, error)
+	redirect bool
+}
+
+// NewTransparentServer returns server for connections redirected with
+// REDIRECT or DNAT target. Original destination is recovered from conntrack.
+func NewTransparentServer(dialer dialer.ContextDialer, logger *clog.CondLogger) *TransparentServer {
+	return &TransparentServer{
+		dialer:   dialer,
+		logger:   logger,
+		origDst:  originalDst,
+		redirect: true,
+	}
+}
+
+// NewTProxyServer returns server for connections delivered with TPROXY
+// target. Listener must have IP_TRANSPARENT option set. Original
+// destination is the local address of accepted connection.
+func NewTProxyServer(dialer dialer.ContextDialer, logger *clog.CondLogger) *TransparentServer {
+	return &TransparentServer{
+		dialer:  dialer,
+		logger:  logger,
+		origDst: localAddrPort,
+	}
+}
+
+func localAddrPort(conn net.Conn) (netip.AddrPort, error) {
+	tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("unexpected local address type %T", conn.LocalAddr())
+	}
+	ap := tcpAddr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), nil
+}
+
+func (s *TransparentServer) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn, l.Addr())
+	}
+}
+
+// serveConn forwards connection accepted by listener bound to listenAddr.
+func (s *TransparentServer) serveConn(conn net.Conn, listenAddr net.Addr) {
+	defer conn.Close()
+
+	dst, err := s.origDst(conn)
+	if err != nil {
+		s.logger.Error("Unable to get original destination of connection from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	selfAddressed := addressesListener(dst, listenAddr)
+	if s.redirect {
+		if local, err := localAddrPort(conn); err == nil && local == dst {
+			selfAddressed = true
+		}
+	}
+	if selfAddressed {
+		s.logger.Error("Connection from %s is addressed to listener itself, refusing to loop", conn.RemoteAddr())
+		return
+	}
+
+	rd := bufio.NewReaderSize(conn, SNIFF_BUF_SIZE)
+	conn.SetReadDeadline(time.Now().Add(SNIFF_TIMEOUT))
+	hostname := sniffHostname(rd)
+	conn.SetReadDeadline(time.Time{})
+
+	address := dst.String()
+	if hostname != "" {
+		address = net.JoinHostPort(hostname, strconv.Itoa(int(dst.Port())))
+	}
+	s.logger.Info("Transparent: %v => %s (original destination %s)", conn.RemoteAddr(), address, dst)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream, err := s.dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		s.logger.Error("Can't connect to %s: %v", address, err)
+		return
+	}
+	proxy(ctx, &peekedConn{
+		Conn: conn,
+		rd:   rd,
+	}, upstream)
+}
+
+// addressesListener reports whether dst is address of listener bound to
+// listenAddr, so connecting to it would loop back into the server.
+func addressesListener(dst netip.AddrPort, listenAddr net.Addr) bool {
+	tcpAddr, ok := listenAddr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	bound := tcpAddr.AddrPort()
+	if dst.Port() != bound.Port() {
+		return false
+	}
+	if boundIP := bound.Addr().Unmap(); !boundIP.IsUnspecified() {
+		return dst.Addr() == boundIP
+	}
+	return isLocalAddr(dst.Addr())
+}
+
+func isLocalAddr(addr netip.Addr) bool {
+	if addr.IsLoopback() || addr.IsUnspecified() {
+		return true
+	}
+	ifAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, ifAddr := range ifAddrs {
+		ipNet, ok := ifAddr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip, ok := netip.AddrFromSlice(ipNet.IP); ok && ip.Unmap() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffHostname peeks at client's first message and extracts destination
+// hostname from TLS ClientHello or HTTP request. Returns empty string if
+// hostname can't be recovered.
+func sniffHostname(rd *bufio.Reader) string {
+	first, err := rd.Peek(1)
+	if err != nil {
+		return ""
+	}
+	if first[0] == 0x16 {
+		return sniffSNI(rd)
+	}
+	return sniffHTTPHost(rd)
+}
+
+func sniffSNI(rd *bufio.Reader) string {
+	hdr, err := rd.Peek(5)
+	if err != nil {
+		return ""
+	}
+	recordLen := int(hdr[3])<<8 | int(hdr[4])
+	if 5+recordLen > SNIFF_BUF_SIZE {
+		return ""
+	}
+	record, err := rd.Peek(5 + recordLen)
+	if err != nil {
+		return ""
+	}
+	sni, _ := parseClientHelloSNI(record[5:])
+	return sni
+}
+
+func parseClientHelloSNI(data []byte) (string, error) {
+	errBad := errors.New("malformed ClientHello")
+	s := cryptobyte.String(data)
+	var (
+		msgType uint8
+		body    cryptobyte.String
+	)
+	if !s.ReadUint8(&msgType) || msgType != 1 || !s.ReadUint24LengthPrefixed(&body) {
+		return "", errBad
+	}
+	var (
+		sessionID, ciphers, compression, extensions cryptobyte.String
+	)
+	if !body.Skip(2+32) ||
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&ciphers) ||
+		!body.ReadUint8LengthPrefixed(&compression) {
+		return "", errBad
+	}
+	if body.Empty() {
+		return "", errors.New("no extensions in ClientHello")
+	}
+	if !body.ReadUint16LengthPrefixed(&extensions) {
+		return "", errBad
+	}
+	for !extensions.Empty() {
+		var (
+			extType uint16
+			extData cryptobyte.String
+		)
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&extData) {
+			return "", errBad
+		}
+		if extType != 0 { // server_name
+			continue
+		}
+		var names cryptobyte.String
+		if !extData.ReadUint16LengthPrefixed(&names) {
+			return "", errBad
+		}
+		for !names.Empty() {
+			var (
+				nameType uint8
+				name     cryptobyte.String
+			)
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				return "", errBad
+			}
+			if nameType == 0 && len(name) > 0 {
+				return string(name), nil
+			}
+		}
+	}
+	return "", errors.New("no SNI in ClientHello")
+}
+
+func sniffHTTPHost(rd *bufio.Reader) string {
+	endOfHeaders := []byte("\r\n\r\n")
+	for n := 1; n <= SNIFF_BUF_SIZE; n = rd.Buffered() + 1 {
+		buf, err := rd.Peek(n)
+		if idx := bytes.Index(buf, endOfHeaders); idx >= 0 {
+			req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:idx+len(endOfHeaders)])))
+			if err != nil {
+				return ""
+			}
+			host := req.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			return host
+		}
+		if err != nil {
+			return ""
+		}
+	}
+	return ""
+}
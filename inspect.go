@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Snawoot/opera-proxy/dialer"
+	clog "github.com/Snawoot/opera-proxy/log"
+	se "github.com/Snawoot/opera-proxy/seclient"
+)
+
+// endpointPeername returns name which certificates of endpoints in country
+// are verified against.
+func endpointPeername(country string) string {
+	return strings.ToLower(country) + "0." + PROXY_SUFFIX
+}
+
+// exportedPeername returns name of i-th discovered endpoint used in
+// exported proxy lists.
+func exportedPeername(ip se.SEIPEntry, i int) string {
+	return fmt.Sprintf("%s%d.%s", strings.ToLower(ip.Geo.CountryCode), i, PROXY_SUFFIX)
+}
+
+// inspectEndpoints connects to every port of every endpoint and prints
+// TLS session parameters and certificate details. Certificate is verified
+// both against name used by opera-proxy and against name exported by
+// -list-proxies and -dp-export for the same endpoint.
+func inspectEndpoints(ips []se.SEIPEntry, d dialer.ContextDialer, country, sni string, caPool *x509.CertPool,
+	timeout time.Duration, logger *clog.CondLogger) int {
+	peername := endpointPeername(country)
+	wr := csv.NewWriter(os.Stdout)
+	defer wr.Flush()
+	wr.Write([]string{"ip", "port", "peername", "verified", "verify_error",
+		"exported_peername", "exported_verified", "exported_verify_error", "tls_version", "cipher_suite",
+		"subject", "sans", "issuer", "not_after", "error"})
+	for i, ip := range ips {
+		exported := exportedPeername(ip, i)
+		ports := ip.Ports
+		if len(ports) == 0 {
+			ports = []uint16{443}
+		}
+		for _, port := range ports {
+			addr := net.JoinHostPort(ip.IP, strconv.Itoa(int(port)))
+			logger.Info("Inspecting endpoint %s...", addr)
+			ctx, cl := context.WithTimeout(context.Background(), timeout)
+			res, err := dialer.InspectTLS(ctx, d, addr, sni, []string{peername, exported}, caPool)
+			cl()
+			row := []string{ip.IP, strconv.Itoa(int(port))}
+			if err != nil {
+				logger.Error("Endpoint %s inspection failed: %v", addr, err)
+				row = append(row, peername, "", "", exported, "", "", "", "", "", "", "", "", err.Error())
+				wr.Write(row)
+				continue
+			}
+			for j, name := range []string{peername, exported} {
+				var verifyError string
+				if res.VerifyErrors[j] != nil {
+					verifyError = res.VerifyErrors[j].Error()
+				}
+				row = append(row, name, strconv.FormatBool(res.VerifyErrors[j] == nil), verifyError)
+			}
+			row = append(row,
+				tls.VersionName(res.Version),
+				tls.CipherSuiteName(res.CipherSuite),
+			)
+			if cert := res.Certificate; cert != nil {
+				sans := append([]string(nil), cert.DNSNames...)
+				for _, ip := range cert.IPAddresses {
+					sans = append(sans, ip.String())
+				}
+				row = append(row,
+					cert.Subject.String(),
+					strings.Join(sans, " "),
+					cert.Issuer.String(),
+					cert.NotAfter.UTC().Format(time.RFC3339),
+					"",
+				)
+			} else {
+				row = append(row, "", "", "", "", "")
+			}
+			wr.Write(row)
+		}
+	}
+	return 0
+}
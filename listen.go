@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	LISTENER_HTTP   = "http"
+	LISTENER_HTTPS  = "https"
+	LISTENER_SOCKS5 = "socks5"
+	LISTENER_MIXED  = "mixed"
+	// Linux-only listeners for connections redirected by netfilter
+	LISTENER_TRANSPARENT = "transparent"
+	LISTENER_TPROXY      = "tproxy"
+)
+
+type listenerSpec struct {
+	proto   string
+	network string
+	address string
+	// country pinned for all connections accepted by listener
+	country string
+}
+
+// parseListenerSpec parses listener specification in form of
+// <proto>://<host>:<port> or <proto>+unix://<socket path>
+func parseListenerSpec(s string) (listenerSpec, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return listenerSpec{}, fmt.Errorf("unable to parse listener spec %q: %w", s, err)
+	}
+	proto, transport, _ := strings.Cut(strings.ToLower(u.Scheme), "+")
+	switch proto {
+	case LISTENER_HTTP, LISTENER_HTTPS, LISTENER_SOCKS5, LISTENER_MIXED, LISTENER_TRANSPARENT, LISTENER_TPROXY:
+	case "socks":
+		proto = LISTENER_SOCKS5
+	default:
+		return listenerSpec{}, fmt.Errorf("unknown listener protocol %q in %q", proto, s)
+	}
+	res := listenerSpec{
+		proto: proto,
+	}
+	switch transport {
+	case "", "tcp":
+		if u.Host == "" {
+			return listenerSpec{}, fmt.Errorf("listen address is missing in %q", s)
+		}
+		res.network = "tcp"
+		res.address = u.Host
+	case "unix":
+		if proto == LISTENER_TRANSPARENT || proto == LISTENER_TPROXY {
+			return listenerSpec{}, fmt.Errorf("%s listener requires TCP transport", proto)
+		}
+		if u.Path == "" {
+			return listenerSpec{}, fmt.Errorf("socket path is missing in %q", s)
+		}
+		res.network = "unix"
+		res.address = u.Path
+	default:
+		return listenerSpec{}, fmt.Errorf("unknown listener transport %q in %q", transport, s)
+	}
+	return res, nil
+}
+
+func (s listenerSpec) String() string {
+	var res string
+	if s.network == "unix" {
+		res = s.proto + "+unix://" + s.address
+	} else {
+		res = s.proto + "://" + s.address
+	}
+	if s.country != "" {
+		res += " (" + s.country + ")"
+	}
+	return res
+}
+
+func (s listenerSpec) Listen() (net.Listener, error) {
+	if s.network == "unix" {
+		if err := removeStaleSocket(s.address); err != nil {
+			return nil, err
+		}
+	}
+	if s.proto == LISTENER_TPROXY {
+		lc, err := tproxyListenConfig()
+		if err != nil {
+			return nil, err
+		}
+		return lc.Listen(context.Background(), s.network, s.address)
+	}
+	return net.Listen(s.network, s.address)
+}
+
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("refusing to replace non-socket file %q", path)
+	}
+	return os.Remove(path)
+}
+
+// countryListenerSpecs returns specs of listeners pinned to countries.
+// Listeners bind consecutive ports on host starting from basePort.
+func countryListenerSpecs(proto, host string, basePort int, countries []string) ([]listenerSpec, error) {
+	if basePort <= 0 || basePort+len(countries)-1 > 65535 {
+		return nil, fmt.Errorf("ports %d-%d are out of range", basePort, basePort+len(countries)-1)
+	}
+	res := make([]listenerSpec, 0, len(countries))
+	seen := make(map[string]bool)
+	for i, country := range countries {
+		country = strings.ToUpper(strings.TrimSpace(country))
+		if country == "" {
+			return nil, errors.New("country can't be empty string")
+		}
+		if seen[country] {
+			return nil, fmt.Errorf("duplicate country %q", country)
+		}
+		seen[country] = true
+		res = append(res, listenerSpec{
+			proto:   proto,
+			network: "tcp",
+			address: net.JoinHostPort(host, strconv.Itoa(basePort+i)),
+			country: country,
+		})
+	}
+	return res, nil
+}
+
+type listenArg struct {
+	values []listenerSpec
+}
+
+func (a *listenArg) String() string {
+	parts := make([]string, len(a.values))
+	for i, v := range a.values {
+		parts[i] = v.String()
+	}
+	return strings.Join(parts, " ")
+}
+
+func (a *listenArg) Set(s string) error {
+	spec, err := parseListenerSpec(s)
+	if err != nil {
+		return err
+	}
+	a.values = append(a.values, spec)
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// IPV6_TRANSPARENT from linux/in6.h
+const IPV6_TRANSPARENT = 75
+
+// tproxyListenConfig returns listen config producing sockets which accept
+// connections to foreign addresses delivered by netfilter TPROXY target.
+func tproxyListenConfig() (*net.ListenConfig, error) {
+	return &net.ListenConfig{
+		Control: func(network, _ string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				switch network {
+				case "tcp4":
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				default:
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, IPV6_TRANSPARENT, 1)
+					if sockErr == nil {
+						// dual-stack socket may receive IPv4 traffic as well
+						syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+					}
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func tproxyListenConfig() (*net.ListenConfig, error) {
+	return nil, errors.New("TPROXY listener is supported only on Linux")
+}
@@ -23,10 +23,12 @@ import (
 
 	xproxy "golang.org/x/net/proxy"
 
+	"github.com/Snawoot/opera-proxy/auth"
 	"github.com/Snawoot/opera-proxy/clock"
 	"github.com/Snawoot/opera-proxy/dialer"
 	"github.com/Snawoot/opera-proxy/handler"
 	clog "github.com/Snawoot/opera-proxy/log"
+	"github.com/Snawoot/opera-proxy/metrics"
 	"github.com/Snawoot/opera-proxy/resolver"
 	se "github.com/Snawoot/opera-proxy/seclient"
 
@@ -37,6 +39,9 @@ import (
 const (
 	API_DOMAIN   = "api2.sec-tunnel.com"
 	PROXY_SUFFIX = "sec-tunnel.com"
+	// Latency based server selection tunnels to API host, so it doesn't
+	// depend on third-party servers.
+	LATENCY_PROBE_TARGET = API_DOMAIN + ":443"
 )
 
 func perror(msg string) {
@@ -99,13 +104,50 @@ func (a *serverSelectionArg) String() string {
 	return a.value.String()
 }
 
+type balancePolicyArg struct {
+	value dialer.BalancePolicy
+}
+
+func (a *balancePolicyArg) Set(s string) error {
+	v, err := dialer.ParseBalancePolicy(s)
+	if err != nil {
+		return err
+	}
+	a.value = v
+	return nil
+}
+
+func (a *balancePolicyArg) String() string {
+	return a.value.String()
+}
+
 type CLIArgs struct {
 	country                string
+	countries              *CSVArg
+	basePort               int
 	listCountries          bool
 	listProxies            bool
 	dpExport               bool
+	benchEndpoints         bool
+	benchFormat            string
+	benchSamples           int
+	inspectEndpoints       bool
 	bindAddress            string
 	socksMode              bool
+	listen                 listenArg
+	auth                   string
+	authDigest             bool
+	certFile               string
+	keyFile                string
+	clientCAFile           string
+	routes                 string
+	pacProxyDomains        *CSVArg
+	pacDirectDomains       *CSVArg
+	pacProxyAddress        string
+	dnsBindAddress         string
+	dohBindAddress         string
+	dnsUpstream            string
+	adminAddress           string
 	verbosity              int
 	timeout                time.Duration
 	showVersion            bool
@@ -120,6 +162,8 @@ type CLIArgs struct {
 	bootstrapDNS           *CSVArg
 	refresh                time.Duration
 	refreshRetry           time.Duration
+	rediscover             time.Duration
+	rediscoverRetry        time.Duration
 	initRetries            int
 	initRetryInterval      time.Duration
 	caFile                 string
@@ -129,6 +173,17 @@ type CLIArgs struct {
 	serverSelectionTimeout time.Duration
 	serverSelectionTestURL string
 	serverSelectionDLLimit int64
+	serverSelectionSamples int
+	failoverCooldown       time.Duration
+	raceDelay              time.Duration
+	stateFile              string
+	discoveryCache         string
+	discoveryCacheTTL      time.Duration
+	countryCacheTTL        time.Duration
+	balance                balancePolicyArg
+	healthCheckInterval    time.Duration
+	healthCheckFailures    int
+	healthCheckReset       time.Duration
 }
 
 func parse_args() *CLIArgs {
@@ -146,14 +201,48 @@ func parse_args() *CLIArgs {
 				"https://doh.cleanbrowsing.org/doh/adult-filter/",
 			},
 		},
-		serverSelection: serverSelectionArg{dialer.ServerSelectionFastest},
+		serverSelection:  serverSelectionArg{dialer.ServerSelectionFastest},
+		countries:        &CSVArg{},
+		pacProxyDomains:  &CSVArg{},
+		pacDirectDomains: &CSVArg{},
 	}
 	flag.StringVar(&args.country, "country", "EU", "desired proxy location")
+	flag.DurationVar(&args.countryCacheTTL, "country-cache-ttl", 5*time.Minute, "time during which list of countries is reused "+
+		"and failed endpoint selection for country requested by client isn't retried")
+	flag.Var(args.countries, "countries", "comma-separated list of countries. Opens listener for each country "+
+		"on consecutive ports starting from -base-port. Listener protocol is chosen as for -bind-address")
+	flag.IntVar(&args.basePort, "base-port", 0, "first port of per-country listeners (default is port of -bind-address)")
 	flag.BoolVar(&args.listCountries, "list-countries", false, "list available countries and exit")
 	flag.BoolVar(&args.listProxies, "list-proxies", false, "output proxy list and exit")
 	flag.BoolVar(&args.dpExport, "dp-export", false, "export configuration for dumbproxy")
+	flag.BoolVar(&args.benchEndpoints, "bench-endpoints", false, "probe every discovered endpoint with download of -server-selection-test-url, output results and exit")
+	flag.StringVar(&args.benchFormat, "bench-format", BENCH_FORMAT_CSV, "output format of endpoint benchmark (csv/json)")
+	flag.IntVar(&args.benchSamples, "bench-samples", 3, "number of probes per endpoint made by endpoint benchmark")
+	flag.BoolVar(&args.inspectEndpoints, "inspect-endpoints", false, "output TLS parameters and certificate details of every discovered endpoint and exit")
 	flag.StringVar(&args.bindAddress, "bind-address", "127.0.0.1:18080", "proxy listen address")
-	flag.BoolVar(&args.socksMode, "socks-mode", false, "listen for SOCKS requests instead of HTTP")
+	flag.BoolVar(&args.socksMode, "socks-mode", false, "listen for SOCKS5/SOCKS4/SOCKS4a requests instead of HTTP")
+	flag.Var(&args.listen, "listen", "add listener in form <proto>://<host>:<port> or <proto>+unix://<socket path>, "+
+		"where proto is one of http, https, socks5, mixed (HTTP and SOCKS on the same port) "+
+		"transparent (Linux only, connections redirected by iptables REDIRECT) "+
+		"or tproxy (Linux only, connections delivered by iptables TPROXY). "+
+		"Can be repeated. Overrides -bind-address and -socks-mode")
+	flag.StringVar(&args.auth, "auth", "", "require clients to authenticate (HTTP and SOCKS5). "+
+		"Format: static://?username=<login>&password=<password> or basicfile://?path=<htpasswd file with bcrypt hashes>")
+	flag.BoolVar(&args.authDigest, "auth-digest", false, "offer Digest proxy authentication in addition to Basic (static auth only)")
+	flag.StringVar(&args.certFile, "cert", "", "enable TLS for HTTP proxy listener and use certificate from this file")
+	flag.StringVar(&args.keyFile, "key", "", "key for TLS certificate")
+	flag.StringVar(&args.clientCAFile, "client-ca", "", "require client certificates signed by CA from this file (mTLS)")
+	flag.StringVar(&args.routes, "routes", "", "file with routing rules selecting tunnel, direct connection or reject per destination")
+	flag.Var(args.pacProxyDomains, "pac-proxy-domains", "comma-separated list of domains routed through proxy by PAC file served at /proxy.pac and /wpad.dat. "+
+		"Empty list means all domains")
+	flag.Var(args.pacDirectDomains, "pac-direct-domains", "comma-separated list of domains accessed directly according to PAC file")
+	flag.StringVar(&args.pacProxyAddress, "pac-proxy-address", "", "proxy address advertised in PAC file (default is address used by client to fetch PAC file)")
+	flag.StringVar(&args.dnsBindAddress, "dns-bind-address", "", "enable local DNS server on this UDP and TCP address resolving names through the tunnel")
+	flag.StringVar(&args.dohBindAddress, "doh-bind-address", "", "enable local DNS-over-HTTP server on this address (path /dns-query) resolving names through the tunnel")
+	flag.StringVar(&args.dnsUpstream, "dns-upstream", "https://1.1.1.1/dns-query", "upstream DNS server reached through the tunnel. "+
+		"Supported schemes are: tcp://, https://")
+	flag.StringVar(&args.adminAddress, "admin-address", "", "enable admin HTTP server with Prometheus metrics at /metrics and JSON control API at /api/ on this address. "+
+		"Address without host binds to 127.0.0.1. Credentials of -auth option are required if it is set")
 	flag.IntVar(&args.verbosity, "verbosity", 20, "logging verbosity "+
 		"(10 - debug, 20 - info, 30 - warning, 40 - error, 50 - critical)")
 	flag.DurationVar(&args.timeout, "timeout", 10*time.Second, "timeout for network operations")
@@ -173,25 +262,110 @@ func parse_args() *CLIArgs {
 			"Supported schemes are: dns://, https://, tls://, tcp://. "+
 			"Examples: https://1.1.1.1/dns-query,tls://9.9.9.9:853")
 	flag.DurationVar(&args.refresh, "refresh", 4*time.Hour, "login refresh interval")
+	flag.StringVar(&args.stateFile, "state-file", "", "file where registered identity and credentials are kept to be reused after restart")
+	flag.StringVar(&args.discoveryCache, "discovery-cache", "", "file where discovered endpoints and country list are cached. "+
+		"Cache is used during startup when it is fresh or when SurfEasy API is unavailable")
+	flag.DurationVar(&args.discoveryCacheTTL, "discovery-cache-ttl", 1*time.Hour, "time during which cached discovery results are used at startup without API request")
 	flag.DurationVar(&args.refreshRetry, "refresh-retry", 5*time.Second, "login refresh retry interval")
+	flag.DurationVar(&args.rediscover, "rediscover", 0, "interval of endpoint rediscovery and server selection, zero disables rediscovery")
+	flag.DurationVar(&args.rediscoverRetry, "rediscover-retry", 1*time.Minute, "rediscovery retry interval")
 	flag.IntVar(&args.initRetries, "init-retries", 0, "number of attempts for initialization steps, zero for unlimited retry")
 	flag.DurationVar(&args.initRetryInterval, "init-retry-interval", 5*time.Second, "delay between initialization retries")
 	flag.StringVar(&args.caFile, "cafile", "", "use custom CA certificate bundle file")
 	flag.StringVar(&args.fakeSNI, "fake-SNI", "", "domain name to use as SNI in communications with servers")
 	flag.StringVar(&args.overrideProxyAddress, "override-proxy-address", "", "use fixed proxy address instead of server address returned by SurfEasy API")
-	flag.Var(&args.serverSelection, "server-selection", "server selection policy (first/random/fastest)")
+	flag.Var(&args.serverSelection, "server-selection", "server selection policy (first/random/fastest/lowest-latency/weighted-random)")
 	flag.DurationVar(&args.serverSelectionTimeout, "server-selection-timeout", 30*time.Second, "timeout given for server selection function to produce result")
 	flag.StringVar(&args.serverSelectionTestURL, "server-selection-test-url", "https://ajax.googleapis.com/ajax/libs/angularjs/1.8.2/angular.min.js",
 		"URL used for download benchmark by fastest server selection policy")
 	flag.Int64Var(&args.serverSelectionDLLimit, "server-selection-dl-limit", 0, "restrict amount of downloaded data per connection by fastest server selection")
+	flag.IntVar(&args.serverSelectionSamples, "server-selection-samples", 1, "number of probes averaged per endpoint by server selection. "+
+		"With more than one sample fastest policy waits for all endpoints instead of taking the first winner")
+	flag.Var(&args.balance, "balance", "spread connections across all discovered endpoints instead of selecting one. "+
+		"Policy is one of none, round-robin, least-conn, consistent-hash")
+	flag.DurationVar(&args.raceDelay, "race-delay", 0, "delay after which connection is also attempted through second endpoint "+
+		"if selected endpoint hasn't established it yet, zero disables racing")
+	flag.DurationVar(&args.failoverCooldown, "failover-cooldown", 1*time.Minute, "time during which failed endpoint is tried only after other discovered endpoints")
+	flag.DurationVar(&args.healthCheckInterval, "health-check-interval", 0, "interval of endpoint health probes, zero disables health checks. "+
+		"Probe establishes tunnel to host of -server-selection-test-url")
+	flag.IntVar(&args.healthCheckFailures, "health-check-failures", 3, "number of consecutive failures which mark endpoint down. "+
+		"Errors reported by endpoint for unreachable destination (502 and 504 responses) and client timeouts are not counted")
+	flag.DurationVar(&args.healthCheckReset, "health-check-reset", 30*time.Second, "time after which endpoint marked down gets trial connection")
 	flag.Func("config", "read configuration from file with space-separated keys and values", readConfig)
 	flag.Parse()
 	if args.country == "" {
 		arg_fail("Country can't be empty string.")
 	}
-	if args.listCountries && args.listProxies || args.listCountries && args.dpExport || args.listProxies && args.dpExport {
+	var outputs int
+	for _, output := range []bool{args.listCountries, args.listProxies, args.dpExport, args.benchEndpoints, args.inspectEndpoints} {
+		if output {
+			outputs++
+		}
+	}
+	if outputs > 1 {
 		arg_fail("mutually exclusive output arguments were provided")
 	}
+	switch args.benchFormat {
+	case BENCH_FORMAT_CSV, BENCH_FORMAT_JSON:
+	default:
+		arg_fail(fmt.Sprintf("unknown benchmark output format %q", args.benchFormat))
+	}
+	if args.benchSamples < 1 {
+		arg_fail("-bench-samples must be positive")
+	}
+	if (args.certFile == "") != (args.keyFile == "") {
+		arg_fail("both -cert and -key must be specified for TLS listener")
+	}
+	if args.clientCAFile != "" && args.certFile == "" {
+		arg_fail("-client-ca requires TLS listener")
+	}
+	if args.serverSelectionSamples < 1 {
+		arg_fail("-server-selection-samples must be positive")
+	}
+	defaultProto := LISTENER_HTTP
+	switch {
+	case args.socksMode && args.certFile != "":
+		arg_fail("TLS listener is supported only for HTTP proxy")
+	case args.socksMode:
+		defaultProto = LISTENER_SOCKS5
+	case args.certFile != "":
+		defaultProto = LISTENER_HTTPS
+	}
+	if args.raceDelay > 0 && args.balance.value != dialer.BalanceNone {
+		arg_fail("-race-delay can't be used together with -balance")
+	}
+	if len(args.countries.values) > 0 && args.overrideProxyAddress != "" {
+		arg_fail("-countries can't be used together with -override-proxy-address")
+	}
+	if len(args.countries.values) > 0 {
+		host, port, err := net.SplitHostPort(args.bindAddress)
+		if err != nil {
+			arg_fail(fmt.Sprintf("bad bind address: %v", err))
+		}
+		basePort := args.basePort
+		if basePort == 0 {
+			basePort, err = strconv.Atoi(port)
+			if err != nil {
+				arg_fail(fmt.Sprintf("bad port in bind address: %v", err))
+			}
+		}
+		specs, err := countryListenerSpecs(defaultProto, host, basePort, args.countries.values)
+		if err != nil {
+			arg_fail(fmt.Sprintf("unable to configure country listeners: %v", err))
+		}
+		args.listen.values = append(args.listen.values, specs...)
+	} else if len(args.listen.values) == 0 {
+		args.listen.values = []listenerSpec{{
+			proto:   defaultProto,
+			network: "tcp",
+			address: args.bindAddress,
+		}}
+	}
+	for _, spec := range args.listen.values {
+		if spec.proto == LISTENER_HTTPS && args.certFile == "" {
+			arg_fail(fmt.Sprintf("listener %s requires -cert and -key", spec))
+		}
+	}
 	return args
 }
 
@@ -222,9 +396,56 @@ func run() int {
 		args.verbosity)
 	socksLogger := log.New(logWriter, "SOCKS   : ",
 		log.LstdFlags|log.Lshortfile)
+	dnsLogger := clog.NewCondLogger(log.New(logWriter, "DNS     : ",
+		log.LstdFlags|log.Lshortfile),
+		args.verbosity)
 
 	mainLogger.Info("opera-proxy client version %s is starting...", version())
 
+	var (
+		proxyAuth auth.Auth
+		credStore auth.CredStore
+	)
+	if args.auth != "" {
+		var err error
+		credStore, err = auth.NewCredStore(args.auth)
+		if err != nil {
+			mainLogger.Critical("Unable to initialize authentication: %v", err)
+			return 17
+		}
+		// Usernames may carry requested country which is not a part of
+		// stored credentials.
+		credStore = auth.NewMappedCredStore(credStore, handler.UsernameWithoutCountry)
+		if args.authDigest {
+			plainStore, ok := credStore.(auth.PlainCredStore)
+			if !ok {
+				mainLogger.Critical("Digest authentication requires static credentials")
+				return 17
+			}
+			proxyAuth, err = auth.NewDigestAuth(plainStore, "", true)
+			if err != nil {
+				mainLogger.Critical("Unable to initialize authentication: %v", err)
+				return 17
+			}
+		} else {
+			proxyAuth = auth.NewBasicAuth(credStore, "")
+		}
+	}
+
+	var (
+		routeRules      []dialer.RouteRule
+		defaultOutbound string
+	)
+	if args.routes != "" {
+		var err error
+		routeRules, defaultOutbound, err = dialer.LoadRouteRules(args.routes)
+		if err != nil {
+			mainLogger.Critical("Unable to load routing rules: %v", err)
+			return 20
+		}
+		mainLogger.Info("Loaded %d routing rules, default outbound is %q", len(routeRules), defaultOutbound)
+	}
+
 	var d dialer.ContextDialer = &net.Dialer{
 		Timeout:   30 * time.Second,
 		KeepAlive: 30 * time.Second,
@@ -329,34 +550,53 @@ func run() int {
 
 	try := retryPolicy(args.initRetries, args.initRetryInterval, mainLogger)
 
-	err = try("anonymous registration", func() error {
-		ctx, cl := context.WithTimeout(context.Background(), args.timeout)
-		defer cl()
-		return seclient.AnonRegister(ctx)
-	})
-	if err != nil {
-		return 9
+	if args.stateFile == "" || !restoreClientState(args.stateFile, seclient, args.timeout, mainLogger) {
+		if args.stateFile != "" {
+			mainLogger.Info("Registering new identity.")
+		}
+		err = try("anonymous registration", func() error {
+			ctx, cl := context.WithTimeout(context.Background(), args.timeout)
+			defer cl()
+			return seclient.AnonRegister(ctx)
+		})
+		if err != nil {
+			return 9
+		}
+
+		err = try("device registration", func() error {
+			ctx, cl := context.WithTimeout(context.Background(), args.timeout)
+			defer cl()
+			return seclient.RegisterDevice(ctx)
+		})
+		if err != nil {
+			return 10
+		}
+	}
+	if args.stateFile != "" {
+		if err := saveClientState(args.stateFile, seclient); err != nil {
+			mainLogger.Error("Unable to save state file %s: %v", args.stateFile, err)
+		}
 	}
 
-	err = try("device registration", func() error {
-		ctx, cl := context.WithTimeout(context.Background(), args.timeout)
-		defer cl()
-		return seclient.RegisterDevice(ctx)
-	})
-	if err != nil {
-		return 10
+	var (
+		disc  discoverer = seclient
+		cache *discoveryCache
+	)
+	if args.discoveryCache != "" {
+		cache = newDiscoveryCache(args.discoveryCache, args.discoveryCacheTTL, seclient, mainLogger)
+		disc = cache
 	}
 
 	if args.listCountries {
-		return printCountries(try, mainLogger, args.timeout, seclient)
+		return printCountries(try, mainLogger, args.timeout, disc)
 	}
 
 	var ips []se.SEIPEntry
-	if args.listProxies || args.dpExport {
+	if args.listProxies || args.dpExport || args.benchEndpoints || args.inspectEndpoints {
 		err = try("discover", func() error {
 			ctx, cl := context.WithTimeout(context.Background(), args.timeout)
 			defer cl()
-			ips, err = seclient.Discover(ctx, fmt.Sprintf("\"%s\",,", args.country))
+			ips, err = disc.Discover(ctx, fmt.Sprintf("\"%s\",,", args.country))
 			if err != nil {
 				return err
 			}
@@ -374,126 +614,447 @@ func run() int {
 		if args.dpExport {
 			return dpExport(ips, seclient, args.fakeSNI)
 		}
+		if args.inspectEndpoints {
+			return inspectEndpoints(ips, d, args.country, args.fakeSNI, caPool, args.timeout, mainLogger)
+		}
 	}
 
-	handlerDialerFactory := func(endpointAddr string) dialer.ContextDialer {
-		return dialer.NewProxyDialer(
+	handlerDialerFactory := func(country, endpointAddr string) dialer.ContextDialer {
+		return dialer.NewMeteredDialer(endpointAddr, dialer.NewProxyDialer(
 			dialer.WrapStringToCb(endpointAddr),
-			dialer.WrapStringToCb(fmt.Sprintf("%s0.%s", args.country, PROXY_SUFFIX)),
+			dialer.WrapStringToCb(endpointPeername(country)),
 			dialer.WrapStringToCb(args.fakeSNI),
 			func() (string, error) {
 				return dialer.BasicAuthHeader(seclient.GetProxyCredentials()), nil
 			},
 			caPool,
-			d)
+			d))
 	}
 
-	var handlerDialer dialer.ContextDialer
+	if args.benchEndpoints {
+		return benchEndpoints(ips, func(endpointAddr string) dialer.ContextDialer {
+			return handlerDialerFactory(args.country, endpointAddr)
+		}, benchOptions{
+			samples: args.benchSamples,
+			url:     args.serverSelectionTestURL,
+			dlLimit: args.serverSelectionDLLimit,
+			tlsConfig: &tls.Config{
+				RootCAs: caPool,
+			},
+			timeout: args.serverSelectionTimeout,
+			format:  args.benchFormat,
+		}, mainLogger)
+	}
+
+	var healthChecker *dialer.HealthChecker
+	if args.healthCheckInterval > 0 {
+		target, err := healthCheckTarget(args.serverSelectionTestURL)
+		if err != nil {
+			mainLogger.Critical("Unable to configure health checks: %v", err)
+			return 23
+		}
+		healthChecker = dialer.NewHealthChecker(target, args.timeout)
+		healthChecker.Run(context.Background(), args.healthCheckInterval)
+	}
+
+	selectEndpoint := func(ctx context.Context, country, group string) (dialer.ContextDialer, string, error) {
+		discoverCtx, cl := context.WithTimeout(ctx, args.timeout)
+		defer cl()
+		res, err := disc.Discover(discoverCtx, fmt.Sprintf("\"%s\",,", country))
+		if err != nil {
+			return nil, "", err
+		}
+		if len(res) == 0 {
+			return nil, "", errors.New("empty endpoints list!")
+		}
+
+		dialers := make([]dialer.ContextDialer, len(res))
+		for i, ep := range res {
+			dialers[i] = handlerDialerFactory(country, ep.NetAddr())
+		}
+		if healthChecker != nil {
+			checked := make([]*dialer.HealthCheckedDialer, len(dialers))
+			for i, ep := range res {
+				epAddr := ep.NetAddr()
+				checked[i] = dialer.NewHealthCheckedDialer(dialers[i], dialer.NewCircuitBreaker(
+					args.healthCheckFailures,
+					args.healthCheckReset,
+					func(from, to dialer.CircuitState) {
+						switch {
+						case from == dialer.CircuitClosed:
+							mainLogger.Warning("Endpoint %s (%s) is marked down", epAddr, country)
+						case to == dialer.CircuitClosed:
+							mainLogger.Info("Endpoint %s (%s) is back up", epAddr, country)
+						}
+					},
+				))
+				dialers[i] = checked[i]
+			}
+			healthChecker.SetGroup(group, checked)
+		}
+		if args.balance.value != dialer.BalanceNone {
+			balancer := dialer.NewBalancingDialer(dialers, args.balance.value)
+			epAddr, _ := balancer.Address()
+			mainLogger.Info("Discovered endpoints: %v. Balancing connections across them with %q policy.", res, args.balance.value)
+			return balancer, epAddr, nil
+		}
+
+		mainLogger.Info("Discovered endpoints: %v. Starting server selection routine %q.", res, args.serverSelection.value)
+		var ss dialer.SelectionFunc
+		switch args.serverSelection.value {
+		case dialer.ServerSelectionFirst:
+			ss = dialer.SelectFirst
+		case dialer.ServerSelectionRandom:
+			ss = dialer.SelectRandom
+		case dialer.ServerSelectionFastest:
+			ss = dialer.NewFastestServerSelectionFunc(
+				args.serverSelectionTestURL,
+				args.serverSelectionDLLimit,
+				&tls.Config{
+					RootCAs: caPool,
+				},
+				args.serverSelectionSamples,
+			)
+		case dialer.ServerSelectionLowestLatency:
+			ss = dialer.NewLowestLatencyServerSelectionFunc(LATENCY_PROBE_TARGET, args.serverSelectionSamples)
+		case dialer.ServerSelectionWeightedRandom:
+			ss = dialer.NewWeightedRandomServerSelectionFunc(LATENCY_PROBE_TARGET, args.serverSelectionSamples)
+		default:
+			panic("unhandled server selection value got past parsing")
+		}
+		selectionCtx, cl := context.WithTimeout(ctx, args.serverSelectionTimeout)
+		defer cl()
+		selected, err := ss(selectionCtx, dialers)
+		if err != nil {
+			return nil, "", err
+		}
+		// Keep remaining endpoints as fallback for selected one
+		ordered := make([]dialer.ContextDialer, 0, len(dialers))
+		ordered = append(ordered, selected)
+		for _, d := range dialers {
+			if d != selected {
+				ordered = append(ordered, d)
+			}
+		}
+		if args.raceDelay > 0 && len(ordered) > 1 {
+			// Selected endpoint races against the rest of endpoints
+			selected = dialer.NewRacingDialer(ordered[0],
+				dialer.NewFailoverDialer(ordered[1:], args.failoverCooldown),
+				args.raceDelay)
+		} else {
+			selected = dialer.NewFailoverDialer(ordered, args.failoverCooldown)
+		}
+		var epAddr string
+		if addresser, ok := selected.(interface{ Address() (string, error) }); ok {
+			if epAddr, err = addresser.Address(); err == nil {
+				mainLogger.Info("Selected endpoint address: %s", epAddr)
+			}
+		}
+		return selected, epAddr, nil
+	}
 
-	if args.overrideProxyAddress == "" {
+	var (
+		initialDialer   dialer.ContextDialer
+		initialEndpoint string
+	)
+	// Connections without country come from listeners not pinned to
+	// country and from DNS servers. Without them endpoint for -country is
+	// never used, so it isn't selected.
+	defaultUsed := args.dnsBindAddress != "" || args.dohBindAddress != ""
+	for _, spec := range args.listen.values {
+		if spec.country == "" {
+			defaultUsed = true
+		}
+	}
+	switch {
+	case args.overrideProxyAddress != "":
+		initialEndpoint = sanitizeFixedProxyAddress(args.overrideProxyAddress)
+		initialDialer = handlerDialerFactory(args.country, initialEndpoint)
+		mainLogger.Info("Endpoint override: %s", initialEndpoint)
+	case defaultUsed:
 		err = try("discover", func() error {
-			ctx, cl := context.WithTimeout(context.Background(), args.timeout)
+			var err error
+			initialDialer, initialEndpoint, err = selectEndpoint(context.Background(), args.country, DEFAULT_ENDPOINT_GROUP)
+			return err
+		})
+		if err != nil {
+			return 12
+		}
+	default:
+		mainLogger.Info("All listeners are pinned to countries, skipping endpoint selection for default country %s.", args.country)
+	}
+	if initialEndpoint != "" {
+		metrics.SetSelectedEndpoint(initialEndpoint)
+	}
+	switchDialer := dialer.NewSwitchDialer(initialDialer)
+	countries := newCountryList(args.countryCacheTTL, disc.GeoList)
+	countryDialer := dialer.NewCountryDialer(switchDialer,
+		func(ctx context.Context, country string) (dialer.ContextDialer, error) {
+			if args.overrideProxyAddress != "" {
+				return nil, fmt.Errorf("country %s requested, but endpoint is fixed by -override-proxy-address", country)
+			}
+			geoCtx, cl := context.WithTimeout(ctx, args.timeout)
 			defer cl()
-			res, err := seclient.Discover(ctx, fmt.Sprintf("\"%s\",,", args.country))
+			known, err := countries.Known(geoCtx, country)
 			if err != nil {
-				return err
-			}
-			if len(res) == 0 {
-				return errors.New("empty endpoints list!")
+				mainLogger.Error("Unable to check country %s: %v", country, err)
+				return nil, err
 			}
-
-			mainLogger.Info("Discovered endpoints: %v. Starting server selection routine %q.", res, args.serverSelection.value)
-			var ss dialer.SelectionFunc
-			switch args.serverSelection.value {
-			case dialer.ServerSelectionFirst:
-				ss = dialer.SelectFirst
-			case dialer.ServerSelectionRandom:
-				ss = dialer.SelectRandom
-			case dialer.ServerSelectionFastest:
-				ss = dialer.NewFastestServerSelectionFunc(
-					args.serverSelectionTestURL,
-					args.serverSelectionDLLimit,
-					&tls.Config{
-						RootCAs: caPool,
-					},
-				)
-			default:
-				panic("unhandled server selection value got past parsing")
+			if !known {
+				mainLogger.Warning("Country %s requested by client is not offered by API", country)
+				return nil, fmt.Errorf("unknown country %s", country)
 			}
-			dialers := make([]dialer.ContextDialer, len(res))
-			for i, ep := range res {
-				dialers[i] = handlerDialerFactory(ep.NetAddr())
+			mainLogger.Info("Selecting endpoint for country %s...", country)
+			d, _, err := selectEndpoint(ctx, country, country)
+			if err != nil {
+				mainLogger.Error("Endpoint selection for country %s failed: %v", country, err)
 			}
-			ctx, cl = context.WithTimeout(context.Background(), args.serverSelectionTimeout)
-			defer cl()
-			handlerDialer, err = ss(ctx, dialers)
+			return d, err
+		}, args.countryCacheTTL)
+	controller := newTunnelController(seclient, switchDialer, countryDialer, selectEndpoint,
+		countries, args.country, initialEndpoint, args.overrideProxyAddress != "", args.timeout, args.stateFile, mainLogger)
+	var handlerDialer dialer.ContextDialer = countryDialer
+	for _, spec := range args.listen.values {
+		if spec.country == "" {
+			continue
+		}
+		// Endpoint is selected directly, so failure isn't cached and next
+		// attempt makes new selection.
+		err = try("discover for country "+spec.country, func() error {
+			mainLogger.Info("Selecting endpoint for country %s...", spec.country)
+			d, _, err := selectEndpoint(context.Background(), spec.country, spec.country)
 			if err != nil {
 				return err
 			}
-			if addresser, ok := handlerDialer.(interface{ Address() (string, error) }); ok {
-				if epAddr, err := addresser.Address(); err == nil {
-					mainLogger.Info("Selected endpoint address: %s", epAddr)
-				}
-			}
+			countryDialer.Replace(spec.country, d)
 			return nil
 		})
 		if err != nil {
 			return 12
 		}
-	} else {
-		sanitizedEndpoint := sanitizeFixedProxyAddress(args.overrideProxyAddress)
-		handlerDialer = handlerDialerFactory(sanitizedEndpoint)
-		mainLogger.Info("Endpoint override: %s", sanitizedEndpoint)
 	}
 
-	clock.RunTicker(context.Background(), args.refresh, args.refreshRetry, func(ctx context.Context) error {
-		mainLogger.Info("Refreshing login...")
-		reqCtx, cl := context.WithTimeout(ctx, args.timeout)
-		defer cl()
-		err := seclient.Login(reqCtx)
-		if err != nil {
-			mainLogger.Error("Login refresh failed: %v", err)
-			return err
+	if cache != nil {
+		// Rediscovery and countries requested by clients need current data
+		discoverUsed, geoListUsed := cache.EndStartup()
+		if args.overrideProxyAddress != "" {
+			discoverUsed = false
+		}
+		if discoverUsed || geoListUsed {
+			go func() {
+				try("refresh of cached discovery results", func() error {
+					ctx, cl := context.WithTimeout(context.Background(), args.timeout+args.serverSelectionTimeout)
+					defer cl()
+					if geoListUsed {
+						if _, err := disc.GeoList(ctx); err != nil {
+							return err
+						}
+						geoListUsed = false
+					}
+					if discoverUsed {
+						return controller.Rediscover(ctx)
+					}
+					return nil
+				})
+			}()
 		}
-		mainLogger.Info("Login refreshed.")
+	}
+	clock.RunTicker(context.Background(), args.refresh, args.refreshRetry, controller.RefreshCredentials)
+	if args.rediscover > 0 {
+		if args.overrideProxyAddress != "" {
+			mainLogger.Warning("Periodic rediscovery is disabled because endpoint is fixed by -override-proxy-address")
+		} else {
+			clock.RunTicker(context.Background(), args.rediscover, args.rediscoverRetry, func(ctx context.Context) error {
+				mainLogger.Info("Rediscovering endpoints...")
+				err := controller.Rediscover(ctx)
+				if err != nil {
+					mainLogger.Error("Rediscovery failed: %v", err)
+				}
+				return err
+			})
+		}
+	}
 
-		mainLogger.Info("Refreshing device password...")
-		reqCtx, cl = context.WithTimeout(ctx, args.timeout)
-		defer cl()
-		err = seclient.DeviceGeneratePassword(reqCtx)
+	if args.routes != "" {
+		handlerDialer = dialer.NewRoutingDialer(routeRules, defaultOutbound, handlerDialer, &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		})
+	}
+
+	mainLogger.Info("Starting proxy server...")
+	pacHandler := handler.NewPACHandler(args.pacProxyAddress, args.pacProxyDomains.values, args.pacDirectDomains.values, proxyLogger)
+	localMux := http.NewServeMux()
+	localMux.Handle("/proxy.pac", pacHandler)
+	localMux.Handle("/wpad.dat", pacHandler)
+	var serverTLSConfig *tls.Config
+	if args.certFile != "" {
+		serverTLSConfig, err = makeServerTLSConfig(args.certFile, args.keyFile, args.clientCAFile)
 		if err != nil {
-			mainLogger.Error("Device password refresh failed: %v", err)
-			return err
+			mainLogger.Critical("Failed to start: %v", err)
+			return 18
 		}
-		mainLogger.Info("Device password refreshed.")
-		return nil
-	})
+	}
+	newServers := func(d dialer.ContextDialer) (*http.Server, *handler.SocksServer, error) {
+		proxyHandler := handler.NewProxyHandler(d, proxyAuth, localMux, proxyLogger)
+		controller.OnEndpointSwitch(proxyHandler.CloseIdleConnections)
+		httpServer := &http.Server{
+			Handler:   proxyHandler,
+			TLSConfig: serverTLSConfig,
+		}
+		socks, err := handler.NewSocksServer(d, credStore, socksLogger)
+		return httpServer, socks, err
+	}
+	httpServer, socks, initError := newServers(handlerDialer)
+	if initError != nil {
+		mainLogger.Critical("Failed to start: %v", initError)
+		return 16
+	}
 
-	mainLogger.Info("Starting proxy server...")
-	if args.socksMode {
-		socks, initError := handler.NewSocksServer(handlerDialer, socksLogger)
+	serveErrors := make(chan error, len(args.listen.values)+4)
+	if args.adminAddress != "" {
+		adminAddress := sanitizeAdminAddress(args.adminAddress)
+		l, initError := net.Listen("tcp", adminAddress)
 		if initError != nil {
-			mainLogger.Critical("Failed to start: %v", err)
-			return 16
+			mainLogger.Critical("Unable to start admin listener: %v", initError)
+			return 22
+		}
+		defer l.Close()
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/metrics", metrics.Handler())
+		adminMux.Handle("/api/", handler.NewAdminHandler(controller, args.timeout+args.serverSelectionTimeout, mainLogger))
+		adminHandler := http.Handler(adminMux)
+		if credStore != nil {
+			adminHandler = auth.RequireBasicAuth(credStore, "", adminMux)
+		} else {
+			mainLogger.Warning("Admin server has no authentication. Set -auth option to protect it.")
+		}
+		mainLogger.Info("Admin server listening on %s", adminAddress)
+		go func() {
+			serveErrors <- fmt.Errorf("admin listener: %w", http.Serve(l, adminHandler))
+		}()
+	}
+	if args.dnsBindAddress != "" || args.dohBindAddress != "" {
+		exchanger, initError := resolver.ExchangerFromURL(args.dnsUpstream, handlerDialer.DialContext, caPool)
+		if initError != nil {
+			mainLogger.Critical("Unable to configure DNS upstream: %v", initError)
+			return 21
+		}
+		dnsServer := handler.NewDNSServer(exchanger, args.timeout, dnsLogger)
+		if args.dnsBindAddress != "" {
+			pc, initError := net.ListenPacket("udp", args.dnsBindAddress)
+			if initError != nil {
+				mainLogger.Critical("Unable to start DNS listener: %v", initError)
+				return 21
+			}
+			defer pc.Close()
+			l, initError := net.Listen("tcp", args.dnsBindAddress)
+			if initError != nil {
+				mainLogger.Critical("Unable to start DNS listener: %v", initError)
+				return 21
+			}
+			defer l.Close()
+			mainLogger.Info("DNS server listening on %s (UDP and TCP), upstream is %s", args.dnsBindAddress, args.dnsUpstream)
+			go func() {
+				serveErrors <- fmt.Errorf("DNS UDP listener: %w", dnsServer.ServeUDP(pc))
+			}()
+			go func() {
+				serveErrors <- fmt.Errorf("DNS TCP listener: %w", dnsServer.ServeTCP(l))
+			}()
+		}
+		if args.dohBindAddress != "" {
+			l, initError := net.Listen("tcp", args.dohBindAddress)
+			if initError != nil {
+				mainLogger.Critical("Unable to start DoH listener: %v", initError)
+				return 21
+			}
+			defer l.Close()
+			dohMux := http.NewServeMux()
+			dohMux.Handle("/dns-query", dnsServer)
+			mainLogger.Info("DoH server listening on %s, upstream is %s", args.dohBindAddress, args.dnsUpstream)
+			go func() {
+				serveErrors <- fmt.Errorf("DoH listener: %w", http.Serve(l, dohMux))
+			}()
 		}
-		mainLogger.Info("Init complete.")
-		err = socks.ListenAndServe("tcp", args.bindAddress)
-	} else {
-		h := handler.NewProxyHandler(handlerDialer, proxyLogger)
-		mainLogger.Info("Init complete.")
-		err = http.ListenAndServe(args.bindAddress, h)
 	}
+	for _, spec := range args.listen.values {
+		l, initError := spec.Listen()
+		if initError != nil {
+			mainLogger.Critical("Unable to start listener %s: %v", spec, initError)
+			return 19
+		}
+		defer l.Close()
+		httpServer, socks, listenerDialer := httpServer, socks, handlerDialer
+		if spec.country != "" {
+			listenerDialer = dialer.NewPinnedCountryDialer(spec.country, handlerDialer)
+			httpServer, socks, initError = newServers(listenerDialer)
+			if initError != nil {
+				mainLogger.Critical("Failed to start: %v", initError)
+				return 16
+			}
+		}
+		var serve func(net.Listener) error
+		switch spec.proto {
+		case LISTENER_HTTP:
+			serve = httpServer.Serve
+		case LISTENER_HTTPS:
+			serve = func(l net.Listener) error {
+				return httpServer.ServeTLS(l, "", "")
+			}
+		case LISTENER_SOCKS5:
+			serve = socks.Serve
+		case LISTENER_TRANSPARENT:
+			serve = handler.NewTransparentServer(listenerDialer, proxyLogger).Serve
+		case LISTENER_TPROXY:
+			serve = handler.NewTProxyServer(listenerDialer, proxyLogger).Serve
+		case LISTENER_MIXED:
+			serve = func(l net.Listener) error {
+				mux := handler.NewProtocolMux(l, args.timeout, proxyLogger)
+				go httpServer.Serve(mux.HTTP())
+				go socks.Serve(mux.SOCKS())
+				return mux.Serve()
+			}
+		default:
+			panic("unhandled listener protocol got past parsing")
+		}
+		mainLogger.Info("Listening on %s", spec)
+		go func(spec listenerSpec, l net.Listener) {
+			serveErrors <- fmt.Errorf("listener %s: %w", spec, serve(l))
+		}(spec, l)
+	}
+	mainLogger.Info("Init complete.")
+	err = <-serveErrors
 	mainLogger.Critical("Server terminated with a reason: %v", err)
 	mainLogger.Info("Shutting down...")
 	return 0
 }
 
-func printCountries(try func(string, func() error) error, logger *clog.CondLogger, timeout time.Duration, seclient *se.SEClient) int {
+// healthCheckTarget returns address of tunnel destination used by health
+// probes.
+func healthCheckTarget(testURL string) (string, error) {
+	u, err := url.Parse(testURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("no host in URL %q", testURL)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if strings.ToLower(u.Scheme) == "http" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+func printCountries(try func(string, func() error) error, logger *clog.CondLogger, timeout time.Duration, disc discoverer) int {
 	var list []se.SEGeoEntry
 	err := try("geolist", func() error {
 		ctx, cl := context.WithTimeout(context.Background(), timeout)
 		defer cl()
-		l, err := seclient.GeoList(ctx)
+		l, err := disc.GeoList(ctx)
 		list = l
 		return err
 	})
@@ -522,7 +1083,7 @@ func printProxies(ips []se.SEIPEntry, seclient *se.SEClient) int {
 	for i, ip := range ips {
 		for _, port := range ip.Ports {
 			wr.Write([]string{
-				fmt.Sprintf("%s%d.%s", strings.ToLower(ip.Geo.CountryCode), i, PROXY_SUFFIX),
+				exportedPeername(ip, i),
 				ip.IP,
 				fmt.Sprintf("%d", port),
 			})
@@ -550,7 +1111,7 @@ func dpExport(ips []se.SEIPEntry, seclient *se.SEClient, sni string) int {
 			),
 			RawQuery: url.Values{
 				"sni":      []string{sni},
-				"peername": []string{fmt.Sprintf("%s%d.%s", strings.ToLower(ip.Geo.CountryCode), i, PROXY_SUFFIX)},
+				"peername": []string{exportedPeername(ip, i)},
 			}.Encode(),
 		}
 		key := "proxy"
@@ -566,6 +1127,31 @@ func dpExport(ips []se.SEIPEntry, seclient *se.SEClient, sni string) int {
 	return 0
 }
 
+func makeServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		certs, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if ok := pool.AppendCertsFromPEM(certs); !ok {
+			return nil, errors.New("unable to load certificates from client CA file")
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
 func sanitizeFixedProxyAddress(addr string) string {
 	if _, _, err := net.SplitHostPort(addr); err == nil {
 		return addr
@@ -573,6 +1159,19 @@ func sanitizeFixedProxyAddress(addr string) string {
 	return net.JoinHostPort(addr, "443")
 }
 
+// sanitizeAdminAddress binds admin server to loopback unless host is
+// specified explicitly.
+func sanitizeAdminAddress(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return net.JoinHostPort("127.0.0.1", addr)
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	return addr
+}
+
 func main() {
 	os.Exit(run())
 }
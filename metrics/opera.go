@@ -0,0 +1,67 @@
+// Package metrics defines Prometheus metrics exposed by opera-proxy.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	DirectionUpstream   = "upstream"
+	DirectionDownstream = "downstream"
+	ResultSuccess       = "success"
+	ResultError         = "error"
+	RaceWinnerPrimary   = "primary"
+	RaceWinnerSecondary = "secondary"
+	RaceWinnerNone      = "none"
+)
+
+var (
+	ActiveTunnels = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "opera_proxy_active_tunnels",
+		Help: "Number of currently open client tunnels.",
+	})
+	BytesCopied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "opera_proxy_bytes_copied_total",
+		Help: "Bytes copied between clients and upstream connections.",
+	}, []string{"direction"})
+	UpstreamDialDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "opera_proxy_upstream_dial_duration_seconds",
+		Help:    "Time taken to establish tunnel through upstream proxy endpoint.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"endpoint", "result"})
+	APIRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "opera_proxy_api_requests_total",
+		Help: "SurfEasy API calls by method and HTTP status code.",
+	}, []string{"method", "code"})
+	LoginRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "opera_proxy_login_refreshes_total",
+		Help: "Login and device password refresh attempts by result.",
+	}, []string{"result"})
+	EndpointFailovers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "opera_proxy_endpoint_failovers_total",
+		Help: "Dial attempts retried on another endpoint after failure.",
+	})
+	EndpointRaces = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "opera_proxy_endpoint_races_total",
+		Help: "Dial attempts made by racing dialer by endpoint which established tunnel.",
+	}, []string{"winner"})
+	SelectedEndpoint = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "opera_proxy_selected_endpoint",
+		Help: "Currently selected upstream endpoint, value is always 1.",
+	}, []string{"endpoint"})
+)
+
+// SetSelectedEndpoint replaces currently reported endpoint.
+func SetSelectedEndpoint(endpoint string) {
+	SelectedEndpoint.Reset()
+	SelectedEndpoint.WithLabelValues(endpoint).Set(1)
+}
+
+// Handler returns HTTP handler exposing metrics of default registry.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,165 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DNS_MESSAGE_CONTENT_TYPE = "application/dns-message"
+	MAX_DNS_MESSAGE_SIZE     = 65535
+	TCP_EXCHANGER_POOL_SIZE  = 8
+)
+
+type DialContextFunc = func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Exchanger sends raw DNS query message to upstream server and returns raw
+// response message.
+type Exchanger interface {
+	Exchange(ctx context.Context, msg []byte) ([]byte, error)
+}
+
+// ExchangerFromURL constructs exchanger for upstream specified by URL.
+// Supported schemes are tcp:// (DNS over TCP) and https:// (DoH).
+// All connections are made with dial function.
+func ExchangerFromURL(u string, dial DialContextFunc, caPool *x509.CertPool) (Exchanger, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	host := parsed.Hostname()
+	port := parsed.Port()
+	switch scheme := strings.ToLower(parsed.Scheme); scheme {
+	case "tcp":
+		if port == "" {
+			port = "53"
+		}
+		return NewTCPExchanger(net.JoinHostPort(host, port), dial), nil
+	case "https", "doh":
+		parsed.Scheme = "https"
+		return NewDoHExchanger(parsed.String(), dial, caPool), nil
+	default:
+		return nil, fmt.Errorf("unsupported DNS upstream scheme %q", scheme)
+	}
+}
+
+// TCPExchanger forwards queries using DNS over TCP. Connections are
+// kept open and reused for subsequent queries.
+type TCPExchanger struct {
+	address string
+	dial    DialContextFunc
+	idle    chan net.Conn
+}
+
+func NewTCPExchanger(address string, dial DialContextFunc) *TCPExchanger {
+	return &TCPExchanger{
+		address: address,
+		dial:    dial,
+		idle:    make(chan net.Conn, TCP_EXCHANGER_POOL_SIZE),
+	}
+}
+
+func (e *TCPExchanger) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	select {
+	case conn := <-e.idle:
+		resp, err := e.exchangeConn(ctx, conn, msg)
+		if err == nil {
+			return resp, nil
+		}
+		// Pooled connection could be closed by server. Retry with new one.
+	default:
+	}
+	conn, err := e.dial(ctx, "tcp", e.address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect DNS upstream %s: %w", e.address, err)
+	}
+	return e.exchangeConn(ctx, conn, msg)
+}
+
+func (e *TCPExchanger) exchangeConn(ctx context.Context, conn net.Conn, msg []byte) ([]byte, error) {
+	if len(msg) > MAX_DNS_MESSAGE_SIZE {
+		conn.Close()
+		return nil, errors.New("DNS message is too long")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Time{})
+	}
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	if _, err := conn.Write(buf); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case e.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return resp, nil
+}
+
+// DoHExchanger forwards queries using DNS over HTTPS (RFC 8484).
+type DoHExchanger struct {
+	url    string
+	client *http.Client
+}
+
+func NewDoHExchanger(url string, dial DialContextFunc, caPool *x509.CertPool) *DoHExchanger {
+	return &DoHExchanger{
+		url: url,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:         dial,
+				MaxIdleConns:        http.DefaultMaxIdleConnsPerHost,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 10 * time.Second,
+				ForceAttemptHTTP2:   true,
+				TLSClientConfig: &tls.Config{
+					RootCAs: caPool,
+				},
+			},
+		},
+	}
+}
+
+func (e *DoHExchanger) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", e.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", DNS_MESSAGE_CONTENT_TYPE)
+	req.Header.Set("Accept", DNS_MESSAGE_CONTENT_TYPE)
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status code %d from DoH server %q", resp.StatusCode, e.url)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, MAX_DNS_MESSAGE_SIZE))
+}
@@ -46,6 +46,16 @@ func (p *SEStatusPair) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// SEError is returned when API rejects request with error status.
+type SEError struct {
+	Status SEStatusPair
+}
+
+func (e *SEError) Error() string {
+	return fmt.Sprintf("API responded with error message: code=%d, msg=\"%s\"",
+		e.Status.Code, e.Status.Message)
+}
+
 type SERegisterSubscriberResponse struct {
 	Data   interface{}  `json:"data"`
 	Status SEStatusPair `json:"return_code"`
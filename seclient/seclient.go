@@ -9,10 +9,14 @@ import (
 	"math/rand"
 	"net/http"
 	"net/url"
+	"path"
+	"strconv"
 	"strings"
 	"sync"
 
 	dac "github.com/Snawoot/go-http-digest-auth-client"
+
+	"github.com/Snawoot/opera-proxy/metrics"
 )
 
 const (
@@ -153,8 +157,7 @@ func (c *SEClient) register(ctx context.Context) error {
 	}
 
 	if regRes.Status.Code != SE_STATUS_OK {
-		return fmt.Errorf("API responded with error message: code=%d, msg=\"%s\"",
-			regRes.Status.Code, regRes.Status.Message)
+		return &SEError{regRes.Status}
 	}
 	return nil
 }
@@ -174,8 +177,7 @@ func (c *SEClient) RegisterDevice(ctx context.Context) error {
 	}
 
 	if regRes.Status.Code != SE_STATUS_OK {
-		return fmt.Errorf("API responded with error message: code=%d, msg=\"%s\"",
-			regRes.Status.Code, regRes.Status.Message)
+		return &SEError{regRes.Status}
 	}
 
 	c.AssignedDeviceID = regRes.Data.DeviceID
@@ -197,8 +199,7 @@ func (c *SEClient) GeoList(ctx context.Context) ([]SEGeoEntry, error) {
 	}
 
 	if geoListRes.Status.Code != SE_STATUS_OK {
-		return nil, fmt.Errorf("API responded with error message: code=%d, msg=\"%s\"",
-			geoListRes.Status.Code, geoListRes.Status.Message)
+		return nil, &SEError{geoListRes.Status}
 	}
 
 	return geoListRes.Data.Geos, nil
@@ -218,8 +219,7 @@ func (c *SEClient) Discover(ctx context.Context, requestedGeo string) ([]SEIPEnt
 	}
 
 	if discoverRes.Status.Code != SE_STATUS_OK {
-		return nil, fmt.Errorf("API responded with error message: code=%d, msg=\"%s\"",
-			discoverRes.Status.Code, discoverRes.Status.Message)
+		return nil, &SEError{discoverRes.Status}
 	}
 
 	return discoverRes.Data.IPs, nil
@@ -233,9 +233,20 @@ func (c *SEClient) Login(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	return c.login(ctx)
+}
+
+// ResumeLogin logs in keeping cookies, so session restored by SetState is
+// continued and cookies survive failed attempt.
+func (c *SEClient) ResumeLogin(ctx context.Context) error {
+	c.Mux.Lock()
+	defer c.Mux.Unlock()
+	return c.login(ctx)
+}
 
+func (c *SEClient) login(ctx context.Context) error {
 	var loginRes SESubscriberLoginResponse
-	err = c.rpcCall(ctx, c.Settings.Endpoints.SubscriberLogin, StrKV{
+	err := c.rpcCall(ctx, c.Settings.Endpoints.SubscriberLogin, StrKV{
 		"login":       c.SubscriberEmail,
 		"password":    c.SubscriberPassword,
 		"client_type": c.Settings.ClientType,
@@ -245,8 +256,7 @@ func (c *SEClient) Login(ctx context.Context) error {
 	}
 
 	if loginRes.Status.Code != SE_STATUS_OK {
-		return fmt.Errorf("API responded with error message: code=%d, msg=\"%s\"",
-			loginRes.Status.Code, loginRes.Status.Message)
+		return &SEError{loginRes.Status}
 	}
 	return nil
 }
@@ -264,8 +274,7 @@ func (c *SEClient) DeviceGeneratePassword(ctx context.Context) error {
 	}
 
 	if genRes.Status.Code != SE_STATUS_OK {
-		return fmt.Errorf("API responded with error message: code=%d, msg=\"%s\"",
-			genRes.Status.Code, genRes.Status.Message)
+		return &SEError{genRes.Status}
 	}
 
 	c.DevicePassword = genRes.Data.DevicePassword
@@ -310,10 +319,13 @@ func (c *SEClient) rpcCall(ctx context.Context, endpoint string, params map[stri
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Set("Accept", "application/json")
 
+	method := path.Base(req.URL.Path)
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
+		metrics.APIRequests.WithLabelValues(method, metrics.ResultError).Inc()
 		return err
 	}
+	metrics.APIRequests.WithLabelValues(method, strconv.Itoa(resp.StatusCode)).Inc()
 
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("bad http status: %s, headers: %#v", resp.Status, resp.Header)
@@ -0,0 +1,96 @@
+package seclient
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// SEState is snapshot of client identity which allows to reuse it after
+// restart.
+type SEState struct {
+	SubscriberEmail    string     `json:"subscriber_email"`
+	SubscriberPassword string     `json:"subscriber_password"`
+	DeviceID           string     `json:"device_id"`
+	AssignedDeviceID   string     `json:"assigned_device_id"`
+	DevicePassword     string     `json:"device_password"`
+	Cookies            []SECookie `json:"cookies,omitempty"`
+}
+
+type SECookie struct {
+	URL   string `json:"url"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func (c *SEClient) endpointURLs() []*url.URL {
+	e := c.Settings.Endpoints
+	var res []*url.URL
+	for _, s := range []string{e.RegisterSubscriber, e.SubscriberLogin, e.RegisterDevice,
+		e.DeviceGeneratePassword, e.GeoList, e.Discover} {
+		if u, err := url.Parse(s); err == nil {
+			res = append(res, u)
+		}
+	}
+	return res
+}
+
+// State returns snapshot of registered identity and API cookies.
+func (c *SEClient) State() SEState {
+	c.Mux.Lock()
+	defer c.Mux.Unlock()
+
+	res := SEState{
+		SubscriberEmail:    c.SubscriberEmail,
+		SubscriberPassword: c.SubscriberPassword,
+		DeviceID:           c.DeviceID,
+		AssignedDeviceID:   c.AssignedDeviceID,
+		DevicePassword:     c.DevicePassword,
+	}
+	// Jar doesn't enumerate cookies, so collect ones sent to API endpoints
+	seen := make(map[string]bool)
+	for _, u := range c.endpointURLs() {
+		for _, cookie := range c.httpClient.Jar.Cookies(u) {
+			key := u.Host + " " + cookie.Name
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			res.Cookies = append(res.Cookies, SECookie{
+				URL:   u.String(),
+				Name:  cookie.Name,
+				Value: cookie.Value,
+			})
+		}
+	}
+	return res
+}
+
+// SetState restores identity saved by State. Client should ResumeLogin
+// after restore to check identity is still valid without dropping restored
+// cookies.
+func (c *SEClient) SetState(state SEState) error {
+	c.Mux.Lock()
+	defer c.Mux.Unlock()
+
+	err := c.resetCookies()
+	if err != nil {
+		return err
+	}
+	for _, cookie := range state.Cookies {
+		u, err := url.Parse(cookie.URL)
+		if err != nil {
+			return err
+		}
+		c.httpClient.Jar.SetCookies(u, []*http.Cookie{{
+			Name:  cookie.Name,
+			Value: cookie.Value,
+		}})
+	}
+	c.SubscriberEmail = state.SubscriberEmail
+	c.SubscriberPassword = state.SubscriberPassword
+	c.DeviceID = state.DeviceID
+	c.AssignedDeviceID = state.AssignedDeviceID
+	c.AssignedDeviceIDHash = capitalHexSHA1(state.AssignedDeviceID)
+	c.DevicePassword = state.DevicePassword
+	return nil
+}
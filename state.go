@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	clog "github.com/Snawoot/opera-proxy/log"
+	se "github.com/Snawoot/opera-proxy/seclient"
+)
+
+// STATE_FILE_MODE restricts access to state file because it holds
+// credentials.
+const STATE_FILE_MODE = 0600
+
+func loadClientState(filename string) (se.SEState, error) {
+	var state se.SEState
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func saveClientState(filename string, seclient *se.SEClient) error {
+	data, err := json.MarshalIndent(seclient.State(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, data, STATE_FILE_MODE)
+}
+
+// writeFileAtomic replaces file atomically, so interrupted write doesn't
+// lose previous content.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	defer os.Remove(tmpName)
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filename)
+}
+
+// restoreClientState loads identity from state file and checks it by login
+// and device password renewal. It reports whether identity was restored.
+func restoreClientState(filename string, seclient *se.SEClient, timeout time.Duration, logger *clog.CondLogger) bool {
+	state, err := loadClientState(filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			logger.Info("State file %s doesn't exist yet.", filename)
+		} else {
+			logger.Warning("Unable to load state file %s: %v", filename, err)
+		}
+		return false
+	}
+	if state.SubscriberEmail == "" || state.AssignedDeviceID == "" {
+		logger.Warning("State file %s has no registered identity.", filename)
+		return false
+	}
+	if err := seclient.SetState(state); err != nil {
+		logger.Warning("Unable to restore state from %s: %v", filename, err)
+		return false
+	}
+
+	// Saved identity is dropped only if API rejects it. If API is
+	// unreachable, saved credentials are used until next refresh.
+	var apiErr *se.SEError
+	ctx, cl := context.WithTimeout(context.Background(), timeout)
+	defer cl()
+	if err := seclient.ResumeLogin(ctx); err != nil {
+		if errors.As(err, &apiErr) {
+			logger.Warning("Login with saved identity failed: %v", err)
+			return false
+		}
+		logger.Warning("Unable to check saved identity, using saved credentials: %v", err)
+		return true
+	}
+	ctx, cl = context.WithTimeout(context.Background(), timeout)
+	defer cl()
+	if err := seclient.DeviceGeneratePassword(ctx); err != nil {
+		if errors.As(err, &apiErr) {
+			logger.Warning("Device password refresh for saved identity failed: %v", err)
+			return false
+		}
+		logger.Warning("Unable to refresh device password, using saved one: %v", err)
+		return true
+	}
+	logger.Info("Reusing identity %s from state file %s.", state.SubscriberEmail, filename)
+	return true
+}